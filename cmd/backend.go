@@ -0,0 +1,62 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/cache/disk"
+	"github.com/dmorgan81/buzzel/pkg/cache/s3"
+)
+
+// newCache opens the cache backend described by spec, one of "mem",
+// "disk:<dir>", "s3:<bucket>", "http:<url>" for an upstream HTTP cache or
+// "grpc:<host:port>" for a remote REAPI cache. S3 buckets send up to uploads
+// uploads at once.
+func newCache(spec string, uploads int) (cache.Cache, error) {
+	kind, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "mem":
+		return cache.NewMemCache(), nil
+	case "disk":
+		if arg == "" {
+			return nil, fmt.Errorf("disk cache dir is required: %s", spec)
+		}
+		return disk.Cache(arg), nil
+	case "s3":
+		if arg == "" {
+			return nil, fmt.Errorf("s3 bucket is required: %s", spec)
+		}
+		return s3.NewCache(arg, s3.Options{Uploads: uploads})
+	case "http":
+		if arg == "" {
+			return nil, fmt.Errorf("upstream url is required: %s", spec)
+		}
+		return newHTTPProxy(arg)
+	case "grpc":
+		if arg == "" {
+			return nil, fmt.Errorf("remote target is required: %s", spec)
+		}
+		return newRemote(arg)
+	}
+	return nil, fmt.Errorf("unknown cache: %s", spec)
+}
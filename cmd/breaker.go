@@ -0,0 +1,45 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// withBreaker wraps a remote backend in the circuit breaker configured by the
+// breaker.* settings, if it's on. Local backends aren't worth breaking.
+func withBreaker(c cache.Cache) cache.Cache {
+	opts := cache.BreakerOptions{
+		Window:        viper.GetDuration("breaker.window"),
+		MinRequests:   viper.GetInt("breaker.min-requests"),
+		ErrorRate:     viper.GetFloat64("breaker.error-rate"),
+		Latency:       viper.GetDuration("breaker.latency"),
+		SlowRate:      viper.GetFloat64("breaker.slow-rate"),
+		ProbeInterval: viper.GetDuration("breaker.probe-interval"),
+	}
+	if opts.ErrorRate <= 0 && opts.Latency <= 0 {
+		return c
+	}
+	log.Info().
+		Float64("error rate", opts.ErrorRate).
+		Dur("latency", opts.Latency).
+		Float64("slow rate", opts.SlowRate).
+		Dur("window", opts.Window).
+		Msg("circuit breaker")
+	return cache.NewBreaker(c, opts)
+}
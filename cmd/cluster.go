@@ -0,0 +1,61 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/cache/cluster"
+	"github.com/spf13/viper"
+)
+
+// newCluster returns the cluster configured by the cluster.* settings and how
+// to discover its members, or nil if clustering is off. shared is set when
+// the members share the backend of c.
+func newCluster(c cache.Cache, token *cache.Token, shared bool) (*cluster.Cache, cluster.Discoverer, error) {
+	peers, name := viper.GetStringSlice("cluster.peers"), viper.GetString("cluster.dns")
+	if len(peers) == 0 && name == "" {
+		return nil, nil, nil
+	}
+
+	opts := cluster.Options{
+		Self:     viper.GetString("cluster.self"),
+		Secret:   viper.GetString("cluster.secret"),
+		Token:    token,
+		Replicas: viper.GetInt("cluster.replicas"),
+		Shared:   shared,
+		Settle:   viper.GetDuration("cluster.settle"),
+	}
+	if opts.Self == "" {
+		return nil, nil, errors.New("cluster.self is required to join a cluster")
+	}
+	if opts.Secret == "" {
+		return nil, nil, errors.New("cluster.secret is required to join a cluster")
+	}
+	if viper.GetDuration("gc.interval") > 0 {
+		// AC entries mostly live on other members than the CAS blobs they
+		// reference, so a member would find nearly all of its blobs
+		// unreferenced
+		return nil, nil, errors.New("gc.interval can't be used in a cluster")
+	}
+
+	var d cluster.Discoverer = cluster.Static(peers)
+	if name != "" {
+		d = cluster.DNS{Name: name, Port: viper.GetInt("cluster.port"), Service: viper.GetString("cluster.service")}
+	}
+	return cluster.New(c, opts), d, nil
+}
@@ -0,0 +1,235 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// configKeyAnnotation names the config key of a flag that's bound to viper
+// under a different name.
+const configKeyAnnotation = "buzzel_config_key"
+
+var sizeInBytes = regexp.MustCompile(`(?i)^\s*\d+\s*([kmg]b?|b)?\s*$`)
+
+func validateSize(s string) error {
+	if !sizeInBytes.MatchString(s) {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	return nil
+}
+
+func validateHeader(s string) error {
+	_, err := parseHeaders([]string{s})
+	return err
+}
+
+// validators check values beyond their flag's type.
+var validators = map[string]func(string) error{
+	"log.level": func(s string) error {
+		_, err := zerolog.ParseLevel(s)
+		return err
+	},
+	"cache.mem.size":     validateSize,
+	"cache.max-size.ac":  validateSize,
+	"cache.max-size.cas": validateSize,
+	"limit.quota":        validateSize,
+	"limit.by": func(s string) error {
+		_, err := identifyBy(s)
+		return err
+	},
+	"compress.min-size":   validateSize,
+	"compress.max-size":   validateSize,
+	"compress.cache-size": validateSize,
+	"compress.encodings":  cache.ValidEncoding,
+	"cache.http.header":   validateHeader,
+	"cache.grpc.header":   validateHeader,
+	"limit.rule": func(s string) error {
+		_, err := cache.ParseLimitRule(s)
+		return err
+	},
+}
+
+// configSchema maps every config key to the flag it sets, for every command.
+func configSchema(root *cobra.Command) map[string]*pflag.Flag {
+	schema := make(map[string]*pflag.Flag)
+	var add func(cmd *cobra.Command)
+	add = func(cmd *cobra.Command) {
+		for _, flags := range []*pflag.FlagSet{cmd.PersistentFlags(), cmd.LocalNonPersistentFlags()} {
+			flags.VisitAll(func(flag *pflag.Flag) {
+				key := flag.Name
+				if keys := flag.Annotations[configKeyAnnotation]; len(keys) > 0 {
+					key = keys[0]
+				}
+				schema[key] = flag
+			})
+		}
+		for _, sub := range cmd.Commands() {
+			add(sub)
+		}
+	}
+	add(root)
+	delete(schema, "config")
+	return schema
+}
+
+// validateConfig checks every key in the config file at path against the
+// flags of root and its commands.
+func validateConfig(root *cobra.Command, path string) error {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+
+	schema := configSchema(root)
+	var errs []string
+	for _, key := range v.AllKeys() {
+		flag, ok := schema[key]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: unknown setting", key))
+			continue
+		}
+		if err := validateValue(flag.Value.Type(), key, v.Get(key)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid config %s: %s", path, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func validateValue(typ, key string, value interface{}) error {
+	var err error
+	values := []string{cast.ToString(value)}
+	switch typ {
+	case "bool":
+		_, err = cast.ToBoolE(value)
+	case "int":
+		_, err = cast.ToIntE(value)
+	case "float64":
+		_, err = cast.ToFloat64E(value)
+	case "duration":
+		_, err = cast.ToDurationE(value)
+	case "string":
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			err = fmt.Errorf("expected a string, got %T", value)
+		}
+	case "stringSlice":
+		values, err = cast.ToStringSliceE(value)
+	}
+	if err != nil {
+		return err
+	}
+
+	if validate, ok := validators[key]; ok {
+		for _, v := range values {
+			if err := validate(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readConfig validates and reads the config file set by --config, if any.
+func readConfig(root *cobra.Command) error {
+	path := viper.GetString("config")
+	if path == "" {
+		return nil
+	}
+	if err := validateConfig(root, path); err != nil {
+		return err
+	}
+	viper.SetConfigFile(path)
+	return viper.ReadInConfig()
+}
+
+// reloader applies the settings that are safe to change while the server is
+// running when the config file changes or on SIGHUP. Anything else needs a
+// restart.
+type reloader struct {
+	lock  sync.Mutex
+	root  *cobra.Command
+	token *cache.Token
+	lru   *cache.LRU
+}
+
+func (r *reloader) watch() {
+	path := viper.GetString("config")
+	if path == "" {
+		return
+	}
+
+	viper.OnConfigChange(func(fsnotify.Event) {
+		r.reload()
+	})
+	viper.WatchConfig()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			r.reload()
+		}
+	}()
+}
+
+func (r *reloader) reload() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	path := viper.GetString("config")
+	if err := readConfig(r.root); err != nil {
+		log.Err(err).Str("config", path).Msg("config reload")
+		return
+	}
+
+	level, _ := zerolog.ParseLevel(viper.GetString("log.level"))
+	zerolog.SetGlobalLevel(level)
+	r.token.Set(viper.GetString("admin.token"))
+	if r.lru != nil {
+		if size := int64(viper.GetSizeInBytes("cache.mem.size")); size > 0 {
+			r.lru.SetMax(size)
+		} else {
+			log.Warn().Msg("disabling the memory cache requires a restart")
+		}
+	}
+	log.Info().
+		Str("config", path).
+		Stringer("log level", level).
+		Str("mem size", viper.GetString("cache.mem.size")).
+		Msg("config reloaded")
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0644)
+		return path
+	}
+
+	assert.NoError(validateConfig(rootCmd, write("ok.yaml", `
+log:
+  level: debug
+cache:
+  mem:
+    size: 512mb
+  ttl:
+    cas: 336h
+  s3:
+    bucket: cache
+migrate:
+  parallel: 4
+limit:
+  rate: 2.5
+  rule:
+  - cas:PUT:rate=50,burst=100
+`)))
+	assert.NoError(validateConfig(rootCmd, write("ok.toml", `
+[log]
+level = "warn"
+pretty = false
+[verify]
+parallel = 8
+`)))
+
+	err := validateConfig(rootCmd, write("bad.yaml", `
+log:
+  level: loud
+  pretty: maybe
+cache:
+  mem:
+    size: lots
+  tiers: []
+gc:
+  grace: soon
+limit:
+  rule: [cas:PUT:speed=1]
+`))
+	if assert.Error(err) {
+		for _, key := range []string{"cache.mem.size", "cache.tiers: unknown setting", "gc.grace", "limit.rule", "log.level", "log.pretty"} {
+			assert.Contains(err.Error(), key)
+		}
+	}
+}
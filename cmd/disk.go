@@ -30,7 +30,7 @@ var diskCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		dir := viper.GetString("cache.disk.dir")
 		log.Info().Str("cache dir", dir).Send()
-		return runServer(disk.Cache(dir))
+		return runServer(disk.Cache(dir), false)
 	},
 }
 
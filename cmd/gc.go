@@ -0,0 +1,71 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+
+	"github.com/dmorgan81/buzzel/pkg/cache/gc"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var gcCmd = &cobra.Command{
+	Use:           "gc <mem|disk:dir|s3:bucket>",
+	Args:          cobra.ExactArgs(1),
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newCache(args[0], 1)
+		if err != nil {
+			return err
+		}
+
+		opts := gc.Options{
+			Grace:  viper.GetDuration("gc.grace"),
+			DryRun: viper.GetBool("gc.dry-run"),
+		}
+		log.Info().Str("cache", args[0]).Dur("grace", opts.Grace).Bool("dry run", opts.DryRun).Msg("gc")
+
+		report, err := gc.Collect(log.Logger.WithContext(context.Background()), c, opts)
+		if err != nil {
+			return err
+		}
+		log.Info().
+			Int("ac entries", report.ACEntries).
+			Int("undecodable", report.Undecodable).
+			Int("referenced", report.Referenced).
+			Int("cas entries", report.CASEntries).
+			Int64("cas bytes", report.CASBytes).
+			Int("unreferenced", report.Unreferenced).
+			Int64("unreferenced bytes", report.UnreferencedBytes).
+			Int("deleted", report.Deleted).
+			Int64("deleted bytes", report.DeletedBytes).
+			Bool("dry run", report.DryRun).
+			Msg("gc report")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+
+	flags := gcCmd.Flags()
+	flags.Bool("gc.dry-run", false, "")
+
+	viper.BindPFlags(flags)
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/cache/remote"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var grpcCmd = &cobra.Command{
+	Use:           "grpc",
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		target := viper.GetString("cache.grpc.target")
+		if target == "" {
+			return errors.New("remote target is required")
+		}
+		r, err := newRemote(target)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		tier := viper.GetString("cache.grpc.tier")
+		log.Info().
+			Str("target", target).
+			Str("instance", viper.GetString("cache.grpc.instance")).
+			Str("tier", tier).
+			Send()
+		upstream := withBreaker(withRetry("cache.grpc", r))
+		if tier == "" {
+			return runServer(upstream, true)
+		}
+		local, err := newCache(tier, 1)
+		if err != nil {
+			return err
+		}
+		return runServer(cache.NewTieredCache(local, upstream), true)
+	},
+}
+
+func newRemote(target string) (*remote.Cache, error) {
+	header, err := parseHeaders(viper.GetStringSlice("cache.grpc.header"))
+	if err != nil {
+		return nil, err
+	}
+	md := make(map[string]string, len(header))
+	for name := range header {
+		md[strings.ToLower(name)] = header.Get(name)
+	}
+	return remote.New(target, remote.Options{
+		Instance: viper.GetString("cache.grpc.instance"),
+		TLS:      viper.GetBool("cache.grpc.tls"),
+		Metadata: md,
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(grpcCmd)
+
+	flags := grpcCmd.Flags()
+	flags.String("cache.grpc.target", "", "")
+	flags.String("cache.grpc.instance", "", "")
+	flags.Bool("cache.grpc.tls", true, "")
+	flags.StringSlice("cache.grpc.header", nil, "")
+	flags.String("cache.grpc.tier", "", "")
+	retryFlags(flags, "cache.grpc", 3)
+
+	viper.BindPFlags(flags)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/cache/httpproxy"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var httpCmd = &cobra.Command{
+	Use:           "http",
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		upstream := viper.GetString("cache.http.upstream")
+		if upstream == "" {
+			return errors.New("upstream url is required")
+		}
+		proxy, err := newHTTPProxy(upstream)
+		if err != nil {
+			return err
+		}
+		upstreamCache := withBreaker(withRetry("cache.http", proxy))
+
+		tier := viper.GetString("cache.http.tier")
+		log.Info().Str("upstream", upstream).Str("tier", tier).Send()
+		if tier == "" {
+			return runServer(upstreamCache, true)
+		}
+		local, err := newCache(tier, 1)
+		if err != nil {
+			return err
+		}
+		return runServer(cache.NewTieredCache(local, upstreamCache), true)
+	},
+}
+
+// parseHeaders parses headers given as "Name: value".
+func parseHeaders(headers []string) (http.Header, error) {
+	h := make(http.Header)
+	for _, header := range headers {
+		i := strings.IndexByte(header, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header %q: expected Name: value", header)
+		}
+		h.Add(strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]))
+	}
+	return h, nil
+}
+
+func newHTTPProxy(upstream string) (*httpproxy.Cache, error) {
+	header, err := parseHeaders(viper.GetStringSlice("cache.http.header"))
+	if err != nil {
+		return nil, err
+	}
+	return httpproxy.New(upstream, httpproxy.Options{
+		Header:  header,
+		Timeout: viper.GetDuration("cache.http.timeout"),
+		Retries: viper.GetInt("cache.http.retries"),
+		Backoff: viper.GetDuration("cache.http.backoff"),
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(httpCmd)
+
+	flags := httpCmd.Flags()
+	flags.String("cache.http.upstream", "", "")
+	flags.StringSlice("cache.http.header", nil, "")
+	flags.Duration("cache.http.timeout", 30*time.Second, "")
+	flags.Int("cache.http.retries", 3, "")
+	flags.Duration("cache.http.backoff", 100*time.Millisecond, "")
+	flags.String("cache.http.tier", "", "")
+	// the client already retries server errors itself
+	retryFlags(flags, "cache.http", 1)
+
+	viper.BindPFlags(flags)
+}
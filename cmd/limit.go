@@ -0,0 +1,68 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/spf13/viper"
+)
+
+// identifyBy returns how clients are identified for limits, either "ip" or
+// "header:<name>".
+func identifyBy(by string) (func(*http.Request) string, error) {
+	switch {
+	case by == "ip":
+		return cache.IdentifyByIP, nil
+	case strings.HasPrefix(by, "header:") && len(by) > len("header:"):
+		return cache.IdentifyByHeader(strings.TrimPrefix(by, "header:")), nil
+	}
+	return nil, fmt.Errorf("invalid client identity %q: expected ip or header:<name>", by)
+}
+
+// newLimits returns the limits configured by the limit.* settings, or nil if
+// there aren't any.
+func newLimits() (*cache.Limits, error) {
+	limits := &cache.Limits{
+		Default: cache.Limit{
+			Rate:        viper.GetFloat64("limit.rate"),
+			Burst:       viper.GetInt("limit.burst"),
+			Concurrency: viper.GetInt("limit.concurrency"),
+		},
+	}
+	limits.Quota = int64(viper.GetSizeInBytes("limit.quota"))
+	limits.QuotaPeriod = viper.GetDuration("limit.quota-period")
+	for _, s := range viper.GetStringSlice("limit.rule") {
+		rule, err := cache.ParseLimitRule(s)
+		if err != nil {
+			return nil, err
+		}
+		limits.Rules = append(limits.Rules, rule)
+	}
+	if limits.Default == (cache.Limit{}) && len(limits.Rules) == 0 && limits.Quota <= 0 {
+		return nil, nil
+	}
+
+	identify, err := identifyBy(viper.GetString("limit.by"))
+	if err != nil {
+		return nil, err
+	}
+	limits.Identify = identify
+	return limits, nil
+}
@@ -27,7 +27,7 @@ var memCmd = &cobra.Command{
 	SilenceUsage:  true,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		log.Info().Msg("mem cache")
-		return runServer(cache.NewMemCache())
+		return runServer(cache.NewMemCache(), false)
 	},
 }
 
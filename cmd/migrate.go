@@ -0,0 +1,98 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache/migrate"
+	"github.com/dmorgan81/buzzel/pkg/cache/scan"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:           "migrate --from <disk:dir|s3:bucket> --to <disk:dir|s3:bucket>",
+	Args:          cobra.NoArgs,
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fromSpec, toSpec := viper.GetString("migrate.from"), viper.GetString("migrate.to")
+		if fromSpec == "" || toSpec == "" {
+			return errors.New("--from and --to are required")
+		}
+		from, err := newCache(fromSpec, 1)
+		if err != nil {
+			return err
+		}
+		to, err := newCache(toSpec, viper.GetInt("migrate.parallel"))
+		if err != nil {
+			return err
+		}
+
+		opts := migrate.Options{
+			Options: scan.Options{
+				Parallel:   viper.GetInt("migrate.parallel"),
+				Checkpoint: viper.GetString("migrate.checkpoint"),
+			},
+			SkipExisting: viper.GetBool("migrate.skip-existing"),
+			Progress:     viper.GetDuration("migrate.progress"),
+		}
+		log.Info().
+			Str("from", fromSpec).
+			Str("to", toSpec).
+			Int("parallel", opts.Parallel).
+			Bool("skip existing", opts.SkipExisting).
+			Str("checkpoint", opts.Checkpoint).
+			Msg("migrate")
+
+		// stopping early leaves the checkpoint behind to resume from
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		report, err := migrate.Migrate(log.Logger.WithContext(ctx), from, to, opts)
+		log.Info().
+			Int64("copied", report.Copied).
+			Int64("bytes", report.Bytes).
+			Int64("existing", report.Existing).
+			Msg("migrate report")
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	flags := migrateCmd.Flags()
+	flags.String("from", "", "")
+	flags.String("to", "", "")
+	flags.Int("parallel", runtime.NumCPU(), "")
+	flags.Bool("skip-existing", false, "")
+	flags.String("checkpoint", "", "")
+	flags.Duration("progress", 10*time.Second, "")
+
+	for _, name := range []string{"from", "to", "parallel", "skip-existing", "checkpoint", "progress"} {
+		flags.SetAnnotation(name, configKeyAnnotation, []string{"migrate." + name})
+		viper.BindPFlag("migrate."+name, flags.Lookup(name))
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// retryFlags adds the settings for retrying and hedging the reads of a
+// backend under prefix.
+func retryFlags(flags *pflag.FlagSet, prefix string, attempts int) {
+	flags.Int(prefix+".retry.attempts", attempts, "")
+	flags.Duration(prefix+".retry.backoff", 50*time.Millisecond, "")
+	flags.Duration(prefix+".retry.max-backoff", 2*time.Second, "")
+	flags.Duration(prefix+".hedge.after", 0, "")
+	flags.Float64(prefix+".hedge.percentile", 0, "")
+}
+
+// withRetry wraps c in the retries and hedging configured under prefix, if
+// there are any.
+func withRetry(prefix string, c cache.Cache) cache.Cache {
+	opts := cache.RetryOptions{
+		Attempts:        viper.GetInt(prefix + ".retry.attempts"),
+		Backoff:         viper.GetDuration(prefix + ".retry.backoff"),
+		MaxBackoff:      viper.GetDuration(prefix + ".retry.max-backoff"),
+		HedgeAfter:      viper.GetDuration(prefix + ".hedge.after"),
+		HedgePercentile: viper.GetFloat64(prefix + ".hedge.percentile"),
+	}
+	if opts.Attempts <= 1 && opts.HedgeAfter <= 0 && opts.HedgePercentile <= 0 {
+		return c
+	}
+	log.Info().
+		Int("attempts", opts.Attempts).
+		Dur("hedge after", opts.HedgeAfter).
+		Float64("hedge percentile", opts.HedgePercentile).
+		Msg(prefix + " retries")
+	return cache.NewRetry(c, opts)
+}
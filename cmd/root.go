@@ -17,13 +17,17 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/cache/gc"
+	health "github.com/etherlabsio/healthcheck/v2"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
@@ -34,6 +38,10 @@ import (
 var rootCmd = &cobra.Command{
 	Use: "buzzel",
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := readConfig(cmd.Root()); err != nil {
+			return err
+		}
+
 		level, err := zerolog.ParseLevel(viper.GetString("log.level"))
 		if err != nil {
 			return err
@@ -51,20 +59,179 @@ var rootCmd = &cobra.Command{
 	},
 }
 
-func runServer(c cache.Cache) error {
+// runServer serves c. shared is set when every instance sees the same entries
+// through c, such as an S3 bucket or an upstream cache.
+func runServer(c cache.Cache, shared bool) error {
 	addr := viper.GetString("cache.addr")
 	size := viper.GetSizeInBytes("cache.mem.size")
 	log.Info().Str("addr", addr).Str("size", viper.GetString("cache.mem.size")).Send()
 
+	ctx, cancel := context.WithCancel(log.Logger.WithContext(context.Background()))
+	defer cancel()
+
+	stats := cache.NewStats(c)
+	c = stats
+	if viper.GetBool("stats.seed") {
+		go func() {
+			start := time.Now()
+			if err := stats.Seed(ctx); err != nil {
+				if !errors.Is(err, context.Canceled) {
+					log.Err(err).Msg("stats seed")
+				}
+				return
+			}
+			log.Info().Dur("duration", time.Since(start)).Msg("stats seeded")
+		}()
+	}
+
+	timeouts := cache.Timeouts{
+		Exists: viper.GetDuration("timeout.exists"),
+		Read:   viper.GetDuration("timeout.read"),
+		Write:  viper.GetDuration("timeout.write"),
+	}
+	if timeouts.Exists > 0 || timeouts.Read > 0 || timeouts.Write > 0 {
+		log.Info().
+			Dur("exists", timeouts.Exists).
+			Dur("read", timeouts.Read).
+			Dur("write", timeouts.Write).
+			Msg("timeouts")
+		c = cache.NewTimeout(c, timeouts)
+	}
+
+	drain := &cache.Drain{}
+	token := cache.NewToken(viper.GetString("admin.token"))
+	opts := []cache.Option{
+		cache.WithAdminToken(token),
+		cache.WithStats(stats),
+		cache.WithReadyCheck("drain", drain),
+	}
+
+	for _, store := range []cache.Store{cache.AC, cache.CAS} {
+		key := "cache.max-size." + store.String()
+		if max := viper.GetSizeInBytes(key); max > 0 {
+			log.Info().Stringer("store", store).Str("max", viper.GetString(key)).Msg("max upload size")
+			opts = append(opts, cache.WithMaxSize(store, int64(max)))
+		}
+	}
+
+	if encodings := viper.GetStringSlice("compress.encodings"); len(encodings) > 0 {
+		compress := cache.CompressOptions{
+			Encodings: encodings,
+			MinSize:   int64(viper.GetSizeInBytes("compress.min-size")),
+			MaxSize:   int64(viper.GetSizeInBytes("compress.max-size")),
+			MaxRatio:  viper.GetFloat64("compress.max-ratio"),
+			CacheSize: int64(viper.GetSizeInBytes("compress.cache-size")),
+			Memory:    int64(viper.GetSizeInBytes("compress.memory")),
+		}
+		log.Info().
+			Strs("encodings", encodings).
+			Str("min size", viper.GetString("compress.min-size")).
+			Str("max size", viper.GetString("compress.max-size")).
+			Float64("max ratio", compress.MaxRatio).
+			Str("cache size", viper.GetString("compress.cache-size")).
+			Str("memory", viper.GetString("compress.memory")).
+			Msg("compression")
+		opts = append(opts, cache.WithCompression(compress))
+	}
+
+	limits, err := newLimits()
+	if err != nil {
+		return err
+	}
+	if limits != nil {
+		log.Info().
+			Float64("rate", limits.Default.Rate).
+			Int("burst", limits.Default.Burst).
+			Int("concurrency", limits.Default.Concurrency).
+			Int("rules", len(limits.Rules)).
+			Int64("quota", limits.Quota).
+			Dur("quota period", limits.QuotaPeriod).
+			Msg("limits")
+	}
+
+	// gc reads below the LRU and TTL so that it doesn't fill the LRU with cold
+	// entries
+	backend := c
+	var lru *cache.LRU
+	snapshot := viper.GetString("cache.mem.snapshot.path")
+	if snapshot == "" && (viper.GetDuration("cache.mem.snapshot.interval") > 0 || viper.GetDuration("cache.mem.warm.budget") > 0) {
+		return errors.New("cache.mem.snapshot.path is required to snapshot or warm the memory cache")
+	}
 	if size > 0 {
-		c = cache.NewLRUCache(c, int64(size))
+		lru = cache.NewLRUCache(c, int64(size))
+		stats.SetLRU(lru)
+		c = lru
+
+		if budget := viper.GetDuration("cache.mem.warm.budget"); budget > 0 {
+			opts = append(opts, cache.WithReadyCheck("warmup", health.CheckerFunc(lru.CheckWarm)))
+			lru.SetWarming()
+			go func() {
+				ctx, cancel := context.WithTimeout(ctx, budget)
+				defer cancel()
+				start := time.Now()
+				loaded, err := lru.Warm(ctx, snapshot)
+				if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+					log.Err(err).Msg("cache warm")
+				}
+				log.Info().Int("loaded", loaded).Dur("duration", time.Since(start)).Msg("cache warm")
+			}()
+		}
+		if interval := viper.GetDuration("cache.mem.snapshot.interval"); interval > 0 {
+			go lru.Snapshotter(ctx, snapshot, interval)
+		}
+	}
+
+	maxAge := map[cache.Store]time.Duration{
+		cache.AC:  viper.GetDuration("cache.ttl.ac"),
+		cache.CAS: viper.GetDuration("cache.ttl.cas"),
+	}
+	if maxAge[cache.AC] > 0 || maxAge[cache.CAS] > 0 {
+		log.Info().Dur("ac", maxAge[cache.AC]).Dur("cas", maxAge[cache.CAS]).Msg("cache ttl")
+		ttl := cache.NewTTLCache(c, maxAge)
+		go ttl.Janitor(ctx, viper.GetDuration("cache.ttl.interval"))
+		c = ttl
+	}
+
+	if interval := viper.GetDuration("gc.interval"); interval > 0 {
+		opts := gc.Options{Grace: viper.GetDuration("gc.grace"), Front: c}
+		log.Info().Dur("interval", interval).Dur("grace", opts.Grace).Msg("gc")
+		go gc.Run(ctx, backend, interval, opts)
 	}
 
+	clustered, discoverer, err := newCluster(c, token, shared)
+	if err != nil {
+		return err
+	}
+	if clustered != nil {
+		log.Info().
+			Str("self", viper.GetString("cluster.self")).
+			Strs("peers", viper.GetStringSlice("cluster.peers")).
+			Str("dns", viper.GetString("cluster.dns")).
+			Int("replicas", viper.GetInt("cluster.replicas")).
+			Msg("cluster")
+		go clustered.Run(ctx, discoverer, viper.GetDuration("cluster.refresh"))
+		// with a single copy of each entry there's nothing to repair
+		if interval := viper.GetDuration("cluster.repair.interval"); interval > 0 && viper.GetInt("cluster.replicas") > 1 && !shared {
+			go clustered.AntiEntropy(ctx, interval)
+		}
+		opts = append(opts, cache.WithMiddleware(clustered.Middleware))
+		c = clustered
+	}
+	if limits != nil {
+		if clustered != nil {
+			// peers are limited where the request first arrived
+			limits.Exempt = clustered.IsForwarded
+		}
+		opts = append(opts, cache.WithLimits(*limits))
+	}
+
+	(&reloader{root: rootCmd, token: token, lru: lru}).watch()
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 
 	errs := make(chan error, 1)
-	s := cache.NewServer(addr, c)
+	s := cache.NewServer(addr, c, opts...)
 	go func() {
 		log.Info().Msg("starting cache server")
 		if err := s.ListenAndServe(); err != http.ErrServerClosed {
@@ -78,7 +245,28 @@ func runServer(c cache.Cache) error {
 	case <-sigs:
 	}
 	log.Info().Msg("stopping cache server")
-	return s.Shutdown(context.TODO())
+
+	// a second signal gives up on shutting down gracefully
+	period := viper.GetDuration("shutdown.drain")
+	shutdownCtx, cancelShutdown := context.WithTimeout(log.Logger.WithContext(context.Background()), period+viper.GetDuration("shutdown.timeout"))
+	defer cancelShutdown()
+	go func() {
+		select {
+		case <-sigs:
+			cancelShutdown()
+		case <-shutdownCtx.Done():
+		}
+	}()
+	if err := cache.Shutdown(shutdownCtx, s, c, drain, period); err != nil {
+		return err
+	}
+	if lru != nil && viper.GetDuration("cache.mem.snapshot.interval") > 0 {
+		// save the latest snapshot for the next start to warm from
+		if err := lru.SaveSnapshot(snapshot); err != nil {
+			log.Err(err).Msg("cache snapshot")
+		}
+	}
+	return nil
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -91,10 +279,57 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	flags := rootCmd.PersistentFlags()
+	flags.String("config", "", "")
 	flags.String("log.level", "info", "")
 	flags.Bool("log.pretty", true, "")
 	flags.String("cache.addr", ":8080", "")
 	flags.String("cache.mem.size", "256mb", "")
+	flags.Duration("cache.mem.warm.budget", 0, "")
+	flags.Duration("cache.mem.snapshot.interval", 0, "")
+	flags.String("cache.mem.snapshot.path", "", "")
+	flags.String("cache.max-size.ac", "0", "")
+	flags.String("cache.max-size.cas", "0", "")
+	flags.Duration("cache.ttl.ac", 0, "")
+	flags.Duration("cache.ttl.cas", 0, "")
+	flags.Duration("cache.ttl.interval", time.Hour, "")
+	flags.Bool("stats.seed", false, "")
+	flags.Duration("gc.interval", 0, "")
+	flags.Duration("gc.grace", 24*time.Hour, "")
+	flags.String("admin.token", "", "")
+	flags.Float64("limit.rate", 0, "")
+	flags.Int("limit.burst", 0, "")
+	flags.Int("limit.concurrency", 0, "")
+	flags.StringSlice("limit.rule", nil, "")
+	flags.String("limit.by", "ip", "")
+	flags.String("limit.quota", "0", "")
+	flags.Duration("limit.quota-period", 24*time.Hour, "")
+	flags.StringSlice("cluster.peers", nil, "")
+	flags.String("cluster.dns", "", "")
+	flags.Int("cluster.port", 8080, "")
+	flags.String("cluster.service", "", "")
+	flags.String("cluster.self", "", "")
+	flags.String("cluster.secret", "", "")
+	flags.Duration("cluster.refresh", 30*time.Second, "")
+	flags.Duration("cluster.settle", 5*time.Minute, "")
+	flags.Int("cluster.replicas", 1, "")
+	flags.Duration("cluster.repair.interval", time.Hour, "")
+	flags.StringSlice("compress.encodings", []string{cache.Zstd, cache.Brotli, cache.Gzip}, "")
+	flags.String("compress.min-size", "1kb", "")
+	flags.String("compress.max-size", "16mb", "")
+	flags.Float64("compress.max-ratio", 0.9, "")
+	flags.String("compress.cache-size", "64mb", "")
+	flags.String("compress.memory", "256mb", "")
+	flags.Duration("timeout.exists", 30*time.Second, "")
+	flags.Duration("timeout.read", 10*time.Minute, "")
+	flags.Duration("timeout.write", 10*time.Minute, "")
+	flags.Float64("breaker.error-rate", 0, "")
+	flags.Duration("breaker.latency", 0, "")
+	flags.Float64("breaker.slow-rate", 0.5, "")
+	flags.Duration("breaker.window", 10*time.Second, "")
+	flags.Int("breaker.min-requests", 20, "")
+	flags.Duration("breaker.probe-interval", 5*time.Second, "")
+	flags.Duration("shutdown.drain", 5*time.Second, "")
+	flags.Duration("shutdown.timeout", 20*time.Second, "")
 
 	viper.BindPFlags(flags)
 }
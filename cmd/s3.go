@@ -35,11 +35,14 @@ var s3Cmd = &cobra.Command{
 		}
 		log.Info().Str("cache bucket", bucket).Send()
 
-		cache, err := s3.NewCache(bucket)
+		cache, err := s3.NewCache(bucket, s3.Options{
+			Uploads:       viper.GetInt("cache.s3.uploads"),
+			NoReadRetries: viper.GetInt("cache.s3.retry.attempts") > 1,
+		})
 		if err != nil {
 			return err
 		}
-		return runServer(cache)
+		return runServer(withBreaker(withRetry("cache.s3", cache)), true)
 	},
 }
 
@@ -48,6 +51,8 @@ func init() {
 
 	flags := s3Cmd.Flags()
 	flags.String("cache.s3.bucket", "", "")
+	flags.Int("cache.s3.uploads", 1, "")
+	retryFlags(flags, "cache.s3", 3)
 
 	viper.BindPFlags(flags)
 }
@@ -0,0 +1,90 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var statsCmd = &cobra.Command{
+	Use:           "stats",
+	Args:          cobra.NoArgs,
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		url := strings.TrimSuffix(viper.GetString("stats.url"), "/") + "/admin/stats"
+		req, err := http.NewRequestWithContext(cmd.Context(), http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+viper.GetString("admin.token"))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", url, resp.Status)
+		}
+
+		var report cache.StatsReport
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			return err
+		}
+
+		for _, store := range []cache.Store{cache.AC, cache.CAS} {
+			st, ok := report.Stores[store]
+			if !ok {
+				continue
+			}
+			log.Info().
+				Stringer("store", store).
+				Int64("entries", st.Entries).
+				Int64("bytes", st.Bytes).
+				Int64("hits", st.Total.Hits).
+				Int64("misses", st.Total.Misses).
+				Float64("hit ratio", st.Total.Ratio).
+				Float64("weekly hit ratio", st.Window.Ratio).
+				Bool("seeded", report.Seeded).
+				Msg("store stats")
+		}
+		if report.LRU != nil {
+			log.Info().Int64("size", report.LRU.Size).Int64("max", report.LRU.Max).Msg("lru stats")
+		}
+		for _, blob := range report.Largest {
+			log.Info().Str("key", blob.Key).Int64("size", blob.Size).Msg("largest blob")
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+
+	flags := statsCmd.Flags()
+	flags.String("stats.url", "http://localhost:8080", "")
+
+	viper.BindPFlags(flags)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"github.com/dmorgan81/buzzel/pkg/cache/scan"
+	"github.com/dmorgan81/buzzel/pkg/cache/verify"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:           "verify <disk:dir|s3:bucket>",
+	Args:          cobra.ExactArgs(1),
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newCache(args[0], viper.GetInt("verify.parallel"))
+		if err != nil {
+			return err
+		}
+
+		opts := verify.Options{
+			Options: scan.Options{
+				Parallel:   viper.GetInt("verify.parallel"),
+				Checkpoint: viper.GetString("verify.checkpoint"),
+			},
+			Quarantine: viper.GetBool("verify.quarantine"),
+		}
+		log.Info().
+			Str("cache", args[0]).
+			Int("parallel", opts.Parallel).
+			Bool("quarantine", opts.Quarantine).
+			Str("checkpoint", opts.Checkpoint).
+			Msg("verify")
+
+		// stopping early leaves the checkpoint behind to resume from
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		report, err := verify.Verify(log.Logger.WithContext(ctx), c, opts)
+		log.Info().
+			Int("verified", report.Verified).
+			Int64("bytes", report.Bytes).
+			Int("corrupt", report.Corrupt).
+			Msg("verify report")
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	flags := verifyCmd.Flags()
+	flags.Int("verify.parallel", runtime.NumCPU(), "")
+	flags.Bool("verify.quarantine", false, "")
+	flags.String("verify.checkpoint", "", "")
+
+	viper.BindPFlags(flags)
+}
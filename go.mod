@@ -4,15 +4,23 @@ go 1.16
 
 require (
 	github.com/NYTimes/gziphandler v1.1.1
+	github.com/andybalholm/brotli v1.0.3
 	github.com/aws/aws-sdk-go-v2 v1.8.0
 	github.com/aws/aws-sdk-go-v2/config v1.6.0
 	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.4.0
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.12.0
 	github.com/etherlabsio/healthcheck/v2 v2.0.0
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/justinas/alice v1.2.0
+	github.com/klauspost/compress v1.13.6
 	github.com/rs/zerolog v1.23.0
+	github.com/spf13/cast v1.3.1
 	github.com/spf13/cobra v1.2.1
+	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.8.1
 	github.com/stretchr/testify v1.7.0
 	golang.org/x/text v0.3.6 // indirect
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	google.golang.org/grpc v1.38.0
+	google.golang.org/protobuf v1.26.0
 )
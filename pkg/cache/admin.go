@@ -0,0 +1,275 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// Token is a bearer token that can be changed while the server is running. The
+// admin API is disabled while it's empty.
+type Token struct {
+	v atomic.Value
+}
+
+func NewToken(token string) *Token {
+	t := &Token{}
+	t.Set(token)
+	return t
+}
+
+func (t *Token) Set(token string) {
+	t.v.Store(token)
+}
+
+// Get returns the token, or nothing for a nil Token.
+func (t *Token) Get() string {
+	if t == nil {
+		return ""
+	}
+	token, _ := t.v.Load().(string)
+	return token
+}
+
+// requireToken only lets requests through to next if they carry token as a
+// bearer token.
+func requireToken(token *Token, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := token.Get()
+		if expected == "" {
+			http.NotFound(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="buzzel"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func storeFromString(s string) (Store, bool) {
+	switch store := Store(s); store {
+	case AC, CAS:
+		return store, true
+	}
+	return "", false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+type purgeRequest struct {
+	Store  string   `json:"store"`
+	Keys   []string `json:"keys,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+}
+
+type purgeResponse struct {
+	Deleted int `json:"deleted"`
+	// Error is why the purge stopped part way, after deleting Deleted
+	// entries.
+	Error string `json:"error,omitempty"`
+}
+
+var hexPrefix = regexp.MustCompile("^[a-f0-9]{1,64}$")
+
+// purgeHandler deletes entries in bulk, either a list of digests or every
+// digest starting with a prefix.
+type purgeHandler struct {
+	Cache
+}
+
+var _ http.Handler = &purgeHandler{}
+
+func (h *purgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store, ok := storeFromString(req.Store)
+	if !ok {
+		http.Error(w, "unknown store "+req.Store, http.StatusBadRequest)
+		return
+	}
+
+	var keys []Key
+	for _, digest := range req.Keys {
+		key, err := keyFromDigest(digest)
+		if err != nil {
+			http.Error(w, "invalid key "+digest, http.StatusBadRequest)
+			return
+		}
+		keys = append(keys, key)
+	}
+	if req.Prefix != "" && !hexPrefix.MatchString(req.Prefix) {
+		http.Error(w, "invalid prefix "+req.Prefix, http.StatusBadRequest)
+		return
+	}
+	if len(keys) == 0 && req.Prefix == "" {
+		http.Error(w, "keys or prefix is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := withUpstreamDelete(r.Context())
+	log := hlog.FromRequest(r).With().Stringer("store", store).Logger()
+	resp := purgeResponse{}
+	err := func() error {
+		for _, key := range keys {
+			if err := Delete(ctx, h.Cache, store, key); err == nil {
+				resp.Deleted++
+			} else if !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		if req.Prefix == "" {
+			return nil
+		}
+
+		// keys are the first two digits of the digest, a slash and the
+		// digest, so those with the prefix sort together and the walk can
+		// start right before them and stop right after
+		after := Key(req.Prefix)
+		if len(req.Prefix) > 1 {
+			after = Key(req.Prefix[:2] + "/" + req.Prefix[:len(req.Prefix)-1])
+		}
+		return WalkAfter(ctx, h.Cache, store, after, func(key Key, _ Info) error {
+			digest := path.Base(string(key))
+			if !strings.HasPrefix(digest, req.Prefix) {
+				if digest > req.Prefix {
+					return StopWalk
+				}
+				return nil
+			}
+			if err := Delete(ctx, h.Cache, store, key); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			resp.Deleted++
+			return nil
+		})
+	}()
+	if err != nil {
+		// say how much was deleted before it failed
+		status := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Err(err).Int("deleted", resp.Deleted).Msg("purge")
+		}
+		resp.Error = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	log.Info().Int("deleted", resp.Deleted).Strs("keys", req.Keys).Str("prefix", req.Prefix).Msg("purged")
+	writeJSON(w, resp)
+}
+
+type listEntry struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+type listResponse struct {
+	Entries []listEntry `json:"entries"`
+	// Next is passed as after to fetch the next page. It's empty on the last
+	// page.
+	Next string `json:"next,omitempty"`
+}
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+// listHandler pages through the entries of a store in key order.
+type listHandler struct {
+	Cache
+}
+
+var _ http.Handler = &listHandler{}
+
+func (h *listHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	store, ok := storeFromString(query.Get("store"))
+	if !ok {
+		http.Error(w, "unknown store "+query.Get("store"), http.StatusBadRequest)
+		return
+	}
+
+	var after Key
+	if digest := query.Get("after"); digest != "" {
+		key, err := keyFromDigest(digest)
+		if err != nil {
+			http.Error(w, "invalid after "+digest, http.StatusBadRequest)
+			return
+		}
+		after = key
+	}
+
+	limit := defaultListLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, "invalid limit "+l, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	resp := listResponse{Entries: make([]listEntry, 0, limit)}
+	if err := WalkAfter(r.Context(), h.Cache, store, after, func(key Key, info Info) error {
+		if len(resp.Entries) == limit {
+			// there's at least one more entry
+			resp.Next = resp.Entries[limit-1].Key
+			return StopWalk
+		}
+		resp.Entries = append(resp.Entries, listEntry{Key: path.Base(string(key)), Size: info.Size, ModTime: info.ModTime})
+		return nil
+	}); err != nil {
+		handleHttpError(w, r, err)
+		return
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,199 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var digests = []string{
+	"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+	"2c3c9bbcc4f1e1a0e07a3e9e2c4b9f5a7f0b26f6b2c1df3e8b2a4f1e5d6c7b8a",
+	"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+}
+
+func fill(c Cache, store Store) {
+	for _, digest := range digests {
+		key, _ := keyFromDigest(digest)
+		w, _ := c.Writer(context.Background(), store, key)
+		w.Write([]byte(digest))
+		w.(io.Closer).Close()
+	}
+}
+
+func TestHandlerDelete(t *testing.T) {
+	assert := assert.New(t)
+	c := NewLRUCache(NewMemCache(), 1024)
+	fill(c, AC)
+
+	h := &handler{Cache: c, store: AC}
+	req := httptest.NewRequest(http.MethodDelete, "/ac/"+digests[0], nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusMethodNotAllowed, w.Result().StatusCode)
+
+	h.adminToken = NewToken("secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusUnauthorized, w.Result().StatusCode)
+
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusNoContent, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusNotFound, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodGet, "/ac/"+digests[0], nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestPurgeHandler(t *testing.T) {
+	assert := assert.New(t)
+	specs := []struct {
+		body    string
+		code    int
+		deleted string
+		remain  []string
+	}{
+		{`{"store": "ac", "keys": ["` + digests[2] + `"]}`, http.StatusOK, `{"deleted":1}`, digests[:2]},
+		{`{"store": "ac", "prefix": "2c"}`, http.StatusOK, `{"deleted":2}`, digests[2:]},
+		{`{"store": "ac", "prefix": "2c2"}`, http.StatusOK, `{"deleted":1}`, digests[1:]},
+		{`{"store": "ac", "prefix": "2c3"}`, http.StatusOK, `{"deleted":1}`, []string{digests[0], digests[2]}},
+		{`{"store": "ac", "prefix": "2"}`, http.StatusOK, `{"deleted":2}`, digests[2:]},
+		{`{"store": "ac", "prefix": "` + digests[2] + `"}`, http.StatusOK, `{"deleted":1}`, digests[:2]},
+		{`{"store": "ac", "prefix": "ff"}`, http.StatusOK, `{"deleted":0}`, digests},
+		{`{"store": "ac"}`, http.StatusBadRequest, "", digests},
+		{`{"store": "ac", "prefix": "zz"}`, http.StatusBadRequest, "", digests},
+		{`{"store": "ac", "keys": ["zz"]}`, http.StatusBadRequest, "", digests},
+		{`{"store": "foo", "prefix": "2c"}`, http.StatusBadRequest, "", digests},
+	}
+
+	for _, s := range specs {
+		c := NewLRUCache(NewMemCache(), 1024)
+		fill(c, AC)
+
+		h := requireToken(NewToken("secret"), &purgeHandler{c})
+		req := httptest.NewRequest(http.MethodPost, "/admin/purge", strings.NewReader(s.body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		resp := w.Result()
+		assert.Equal(s.code, resp.StatusCode, s.body)
+		if s.deleted != "" {
+			body, _ := io.ReadAll(resp.Body)
+			assert.JSONEq(s.deleted, string(body), s.body)
+		}
+
+		var remain []string
+		Walk(context.Background(), c, AC, func(key Key, _ Info) error {
+			remain = append(remain, string(key)[3:])
+			return nil
+		})
+		assert.Equal(s.remain, remain, s.body)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/purge", bytes.NewReader(nil))
+	w := httptest.NewRecorder()
+	requireToken(NewToken("secret"), &purgeHandler{NewMemCache()}).ServeHTTP(w, req)
+	assert.Equal(http.StatusUnauthorized, w.Result().StatusCode)
+
+	// a purge that fails part way says how much it deleted
+	c := NewMemCache()
+	fill(c, AC)
+	failing, _ := keyFromDigest(digests[1])
+	req = httptest.NewRequest(http.MethodPost, "/admin/purge", strings.NewReader(`{"store": "ac", "prefix": "2c"}`))
+	w = httptest.NewRecorder()
+	(&purgeHandler{&failingDelete{c, failing}}).ServeHTTP(w, req)
+	assert.Equal(http.StatusInternalServerError, w.Result().StatusCode)
+	body, _ := io.ReadAll(w.Result().Body)
+	assert.JSONEq(`{"deleted":1,"error":"delete failed"}`, string(body))
+}
+
+type failingDelete struct {
+	*MemCache
+	key Key
+}
+
+func (c *failingDelete) Delete(ctx context.Context, store Store, key Key) error {
+	if key == c.key {
+		return errors.New("delete failed")
+	}
+	return c.MemCache.Delete(ctx, store, key)
+}
+
+func TestListHandler(t *testing.T) {
+	assert := assert.New(t)
+	c := NewLRUCache(NewMemCache(), 1024)
+	fill(c, CAS)
+
+	list := func(query string) (int, listResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/list?"+query, nil)
+		w := httptest.NewRecorder()
+		(&listHandler{c}).ServeHTTP(w, req)
+
+		var resp listResponse
+		json.NewDecoder(w.Result().Body).Decode(&resp)
+		return w.Result().StatusCode, resp
+	}
+	keys := func(resp listResponse) []string {
+		var keys []string
+		for _, entry := range resp.Entries {
+			keys = append(keys, entry.Key)
+		}
+		return keys
+	}
+
+	code, resp := list("store=cas")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(digests, keys(resp))
+	assert.Empty(resp.Next)
+	assert.Equal(int64(64), resp.Entries[0].Size)
+
+	code, resp = list("store=cas&limit=2")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(digests[:2], keys(resp))
+	assert.Equal(digests[1], resp.Next)
+
+	code, resp = list("store=cas&limit=2&after=" + resp.Next)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(digests[2:], keys(resp))
+	assert.Empty(resp.Next)
+
+	code, resp = list("store=ac")
+	assert.Equal(http.StatusOK, code)
+	assert.Empty(resp.Entries)
+
+	for _, query := range []string{"store=foo", "store=cas&limit=0", "store=cas&after=zz"} {
+		code, _ = list(query)
+		assert.Equal(http.StatusBadRequest, code, query)
+	}
+}
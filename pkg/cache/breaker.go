@@ -0,0 +1,334 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	health "github.com/etherlabsio/healthcheck/v2"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrBreakerOpen is returned by operations that can't be skipped quietly while
+// a Breaker is open, such as walks.
+var ErrBreakerOpen = errors.New("cache: circuit breaker open")
+
+// BreakerOptions configures when a Breaker trips.
+type BreakerOptions struct {
+	// Window is how far back requests are counted.
+	Window time.Duration
+	// MinRequests is how many requests the window needs before it can trip.
+	MinRequests int
+	// ErrorRate is the fraction of failed requests that trips the breaker,
+	// unless it's zero.
+	ErrorRate float64
+	// Requests slower than Latency count as slow, and SlowRate is the
+	// fraction of slow requests that trips the breaker, unless Latency is
+	// zero.
+	Latency  time.Duration
+	SlowRate float64
+	// ProbeInterval is how often the cache is checked while the breaker is
+	// open.
+	ProbeInterval time.Duration
+}
+
+// breakerBuckets is how many buckets the window is split into.
+const breakerBuckets = 10
+
+type breakerBucket struct {
+	epoch    int64
+	total    int
+	failures int
+	slow     int
+}
+
+// Breaker stops sending requests to a cache that's failing or slow. Once it
+// trips, reads miss and writes are dropped straight away, so that clients
+// carry on without the cache and wrappers like LRU keep serving what they
+// hold, until the cache passes its health check again. Caches that don't
+// implement health.Checker are tried again after ProbeInterval.
+type Breaker struct {
+	cache Cache
+	opts  BreakerOptions
+
+	lock    sync.Mutex
+	buckets [breakerBuckets]breakerBucket
+	open    bool
+	probing bool
+	probed  time.Time
+}
+
+var _ Cache = &Breaker{}
+
+func NewBreaker(cache Cache, opts BreakerOptions) *Breaker {
+	if opts.Window <= 0 {
+		opts.Window = 10 * time.Second
+	}
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = 5 * time.Second
+	}
+	return &Breaker{cache: cache, opts: opts}
+}
+
+// Open reports whether the breaker has tripped.
+func (c *Breaker) Open() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.open
+}
+
+// begin admits a request, returning false if the breaker is open. Otherwise
+// done must be called with its result.
+func (c *Breaker) begin(ctx context.Context) (func(error), bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.open {
+		c.probe()
+		return nil, false
+	}
+
+	start := time.Now()
+	return func(err error) {
+		// clients giving up says nothing about the cache, unlike running
+		// out of time
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		}
+		failed := err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrInvalidRange)
+		c.record(failed, time.Since(start))
+	}, true
+}
+
+func (c *Breaker) record(failed bool, latency time.Duration) {
+	now := time.Now()
+	width := int64(c.opts.Window) / breakerBuckets
+	epoch := now.UnixNano() / width
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.open {
+		return
+	}
+
+	b := &c.buckets[epoch%breakerBuckets]
+	if b.epoch != epoch {
+		*b = breakerBucket{epoch: epoch}
+	}
+	b.total++
+	if failed {
+		b.failures++
+	}
+	if c.opts.Latency > 0 && latency > c.opts.Latency {
+		b.slow++
+	}
+
+	var total, failures, slow int
+	for _, b := range c.buckets {
+		if epoch-b.epoch < breakerBuckets {
+			total += b.total
+			failures += b.failures
+			slow += b.slow
+		}
+	}
+	if total < c.opts.MinRequests || total == 0 {
+		return
+	}
+	errorRate, slowRate := float64(failures)/float64(total), float64(slow)/float64(total)
+	if (c.opts.ErrorRate > 0 && errorRate >= c.opts.ErrorRate) || (c.opts.Latency > 0 && slowRate >= c.opts.SlowRate) {
+		log.Warn().
+			Int("requests", total).
+			Float64("error rate", errorRate).
+			Float64("slow rate", slowRate).
+			Msg("circuit breaker open")
+		c.open = true
+		c.probed = now
+		c.buckets = [breakerBuckets]breakerBucket{}
+	}
+}
+
+// probe checks whether the cache has recovered if it's been long enough since
+// the last check. It's called with the lock held.
+func (c *Breaker) probe() {
+	if c.probing || time.Since(c.probed) < c.opts.ProbeInterval {
+		return
+	}
+	c.probing = true
+
+	go func() {
+		var err error
+		if checker, ok := c.cache.(health.Checker); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), c.opts.ProbeInterval)
+			err = checker.Check(ctx)
+			cancel()
+		}
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.probing = false
+		c.probed = time.Now()
+		if err != nil {
+			log.Debug().Err(err).Msg("circuit breaker probe")
+			return
+		}
+		log.Info().Msg("circuit breaker closed")
+		c.open = false
+	}()
+}
+
+func (c *Breaker) Exists(ctx context.Context, store Store, key Key) error {
+	done, ok := c.begin(ctx)
+	if !ok {
+		return ErrNotFound
+	}
+	err := c.cache.Exists(ctx, store, key)
+	done(err)
+	return err
+}
+
+func (c *Breaker) Stat(ctx context.Context, store Store, key Key) (Info, error) {
+	done, ok := c.begin(ctx)
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	info, err := c.cache.Stat(ctx, store, key)
+	done(err)
+	return info, err
+}
+
+func (c *Breaker) Reader(ctx context.Context, store Store, key Key) (io.Reader, int64, error) {
+	done, ok := c.begin(ctx)
+	if !ok {
+		return nil, -1, ErrNotFound
+	}
+	reader, size, err := c.cache.Reader(ctx, store, key)
+	done(err)
+	return reader, size, err
+}
+
+var _ RangeReader = &Breaker{}
+
+func (c *Breaker) RangeReader(ctx context.Context, store Store, key Key, offset, length int64) (io.Reader, int64, error) {
+	done, ok := c.begin(ctx)
+	if !ok {
+		return nil, -1, ErrNotFound
+	}
+	reader, size, err := ReadRange(ctx, c.cache, store, key, offset, length)
+	done(err)
+	return reader, size, err
+}
+
+// Writer drops writes while the breaker is open, so that uploads succeed
+// without being stored, as they would have if the cache had them already.
+// Otherwise failing to store the entry on Close counts against the cache,
+// though slow uploads don't since their time depends on their size.
+func (c *Breaker) Writer(ctx context.Context, store Store, key Key) (io.Writer, error) {
+	done, ok := c.begin(ctx)
+	if !ok {
+		zerolog.Ctx(ctx).Debug().Caller().
+			Stringer("store", store).
+			Stringer("key", key).
+			Msg("breaker open, write dropped")
+		return ioutil.Discard, nil
+	}
+	writer, err := c.cache.Writer(ctx, store, key)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+	return &breakerWriter{Writer: writer, breaker: c, ctx: ctx}, nil
+}
+
+type breakerWriter struct {
+	io.Writer
+	breaker *Breaker
+	ctx     context.Context
+}
+
+func (w *breakerWriter) Close() error {
+	var err error
+	if closer, ok := w.Writer.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if !errors.Is(w.ctx.Err(), context.Canceled) {
+		w.breaker.record(err != nil, 0)
+	}
+	return err
+}
+
+var _ Replacer = &breakerWriter{}
+
+func (w *breakerWriter) Replaced() int64 {
+	return Replaced(w.Writer)
+}
+
+var _ Aborter = &breakerWriter{}
+
+func (w *breakerWriter) Abort() error {
+	return Abort(w.Writer)
+}
+
+var _ Deleter = &Breaker{}
+
+func (c *Breaker) Delete(ctx context.Context, store Store, key Key) error {
+	if c.Open() {
+		return ErrBreakerOpen
+	}
+	return Delete(ctx, c.cache, store, key)
+}
+
+var _ Walker = &Breaker{}
+
+func (c *Breaker) Walk(ctx context.Context, store Store, fn WalkFunc) error {
+	if c.Open() {
+		return ErrBreakerOpen
+	}
+	return Walk(ctx, c.cache, store, fn)
+}
+
+var _ SeekWalker = &Breaker{}
+
+func (c *Breaker) WalkAfter(ctx context.Context, store Store, after Key, fn WalkFunc) error {
+	if c.Open() {
+		return ErrBreakerOpen
+	}
+	return WalkAfter(ctx, c.cache, store, after, fn)
+}
+
+var _ Flusher = &Breaker{}
+
+func (c *Breaker) Flush(ctx context.Context) error {
+	return Flush(ctx, c.cache)
+}
+
+var _ health.Checker = &Breaker{}
+
+// Check passes while the breaker is open, since it's serving what it can
+// without the cache and probing it already.
+func (c *Breaker) Check(ctx context.Context) error {
+	if c.Open() {
+		return nil
+	}
+	if checker, ok := c.cache.(health.Checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
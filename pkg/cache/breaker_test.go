@@ -0,0 +1,112 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyCache fails every request while failing is set.
+type flakyCache struct {
+	Cache
+	failing int32
+	calls   int32
+}
+
+var errFlaky = errors.New("flaky")
+
+func (c *flakyCache) Exists(ctx context.Context, store Store, key Key) error {
+	atomic.AddInt32(&c.calls, 1)
+	if atomic.LoadInt32(&c.failing) != 0 {
+		return errFlaky
+	}
+	return c.Cache.Exists(ctx, store, key)
+}
+
+func (c *flakyCache) Check(ctx context.Context) error {
+	if atomic.LoadInt32(&c.failing) != 0 {
+		return errFlaky
+	}
+	return nil
+}
+
+func TestBreaker(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	flaky := &flakyCache{Cache: NewMemCache()}
+	c := NewBreaker(flaky, BreakerOptions{
+		Window:        time.Minute,
+		MinRequests:   4,
+		ErrorRate:     0.5,
+		ProbeInterval: 10 * time.Millisecond,
+	})
+
+	// misses aren't failures
+	for i := 0; i < 10; i++ {
+		assert.True(errors.Is(c.Exists(ctx, CAS, "a"), ErrNotFound))
+	}
+	assert.False(c.Open())
+
+	atomic.StoreInt32(&flaky.failing, 1)
+	for i := 0; i < 10; i++ {
+		assert.Equal(errFlaky, c.Exists(ctx, CAS, "a"))
+	}
+	assert.True(c.Open())
+
+	// while open, requests don't reach the cache and uploads are dropped
+	calls := atomic.LoadInt32(&flaky.calls)
+	assert.True(errors.Is(c.Exists(ctx, CAS, "a"), ErrNotFound))
+	w, err := c.Writer(ctx, CAS, "a")
+	assert.NoError(err)
+	w.Write([]byte("foo"))
+	rec := httptest.NewRecorder()
+	sha := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	(&handler{Cache: c, store: AC}).ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/ac/"+sha, bytes.NewReader([]byte("foo"))))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(calls, atomic.LoadInt32(&flaky.calls))
+	assert.True(errors.Is(flaky.Cache.Exists(ctx, CAS, "a"), ErrNotFound))
+	assert.True(errors.Is(c.Walk(ctx, CAS, func(Key, Info) error { return nil }), ErrBreakerOpen))
+	assert.NoError(c.Check(ctx))
+
+	// it closes once the cache passes its check
+	time.Sleep(20 * time.Millisecond)
+	c.Exists(ctx, CAS, "a")
+	time.Sleep(20 * time.Millisecond)
+	assert.True(c.Open())
+
+	atomic.StoreInt32(&flaky.failing, 0)
+	assert.Eventually(func() bool {
+		c.Exists(ctx, CAS, "a")
+		return !c.Open()
+	}, time.Second, 5*time.Millisecond)
+
+	w, err = c.Writer(ctx, CAS, "a")
+	if assert.NoError(err) {
+		w.Write([]byte("foo"))
+		assert.NoError(w.(io.Closer).Close())
+	}
+	assert.NoError(c.Exists(ctx, CAS, "a"))
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 type Store string
@@ -38,10 +39,233 @@ func (k Key) String() string {
 	return string(k)
 }
 
+// Info describes a cache entry.
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
 type Cache interface {
 	Exists(context.Context, Store, Key) error
+	Stat(context.Context, Store, Key) (Info, error)
 	Reader(context.Context, Store, Key) (io.Reader, int64, error)
 	Writer(context.Context, Store, Key) (io.Writer, error)
 }
 
-var ErrNotFound = errors.New("cache: not found")
+// RangeReader is implemented by caches that can read part of an entry without
+// fetching all of it. A negative offset reads the last -offset bytes of the
+// entry and a negative length reads through to the end. The returned size is
+// the size of the whole entry.
+type RangeReader interface {
+	RangeReader(ctx context.Context, store Store, key Key, offset, length int64) (io.Reader, int64, error)
+}
+
+// Deleter is implemented by caches that can remove entries.
+type Deleter interface {
+	Delete(ctx context.Context, store Store, key Key) error
+}
+
+// WalkFunc is called by Walk for each entry in a store. Returning StopWalk
+// ends the walk early without error.
+type WalkFunc func(key Key, info Info) error
+
+// Walker is implemented by caches that can enumerate the entries in a store.
+// Entries are visited in lexical order of their keys.
+type Walker interface {
+	Walk(ctx context.Context, store Store, fn WalkFunc) error
+}
+
+// SeekWalker is implemented by Walkers that can start a walk part way through
+// a store without visiting the entries before it.
+type SeekWalker interface {
+	WalkAfter(ctx context.Context, store Store, after Key, fn WalkFunc) error
+}
+
+// Aborter is implemented by writers that can discard what was written to them
+// instead of storing it, such as when an upload turns out to be incomplete.
+// Close is not called after Abort.
+type Aborter interface {
+	Abort() error
+}
+
+// Replacer is implemented by writers that know, once closed, whether they
+// replaced an entry. Replaced returns the size of the entry replaced, or -1
+// if there wasn't one.
+type Replacer interface {
+	Replaced() int64
+}
+
+// Replaced returns the size of the entry replaced by closing w, or -1 if
+// there wasn't one or w can't tell.
+func Replaced(w io.Writer) int64 {
+	if r, ok := w.(Replacer); ok {
+		return r.Replaced()
+	}
+	return -1
+}
+
+// Flusher is implemented by caches that finish writes in the background after
+// their writers are closed.
+type Flusher interface {
+	// Flush waits for pending writes to finish or ctx to be done.
+	Flush(ctx context.Context) error
+}
+
+var (
+	ErrNotFound     = errors.New("cache: not found")
+	ErrInvalidRange = errors.New("cache: invalid range")
+	ErrNotSupported = errors.New("cache: not supported")
+
+	StopWalk = errors.New("cache: stop walk")
+)
+
+// Delete removes an entry from c if it implements Deleter.
+func Delete(ctx context.Context, c Cache, store Store, key Key) error {
+	if d, ok := c.(Deleter); ok {
+		return d.Delete(ctx, store, key)
+	}
+	return ErrNotSupported
+}
+
+// Walk calls fn for each entry of store in c if it implements Walker.
+func Walk(ctx context.Context, c Cache, store Store, fn WalkFunc) error {
+	if w, ok := c.(Walker); ok {
+		if err := w.Walk(ctx, store, fn); err != nil && !errors.Is(err, StopWalk) {
+			return err
+		}
+		return nil
+	}
+	return ErrNotSupported
+}
+
+// WalkAfter calls fn for each entry of store in c whose key sorts after the
+// given key. Walkers that don't implement SeekWalker have the entries before
+// it skipped.
+func WalkAfter(ctx context.Context, c Cache, store Store, after Key, fn WalkFunc) error {
+	if after == "" {
+		return Walk(ctx, c, store, fn)
+	}
+	if w, ok := c.(SeekWalker); ok {
+		if err := w.WalkAfter(ctx, store, after, fn); err != nil && !errors.Is(err, StopWalk) {
+			return err
+		}
+		return nil
+	}
+	return Walk(ctx, c, store, func(key Key, info Info) error {
+		if key <= after {
+			return nil
+		}
+		return fn(key, info)
+	})
+}
+
+// Abort discards what was written to w if it implements Aborter, and closes it
+// otherwise, which is the best that can be done.
+func Abort(w io.Writer) error {
+	if a, ok := w.(Aborter); ok {
+		return a.Abort()
+	}
+	if closer, ok := w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Flush waits for pending writes in c if it implements Flusher. Caches that
+// don't have nothing to wait for.
+func Flush(ctx context.Context, c Cache) error {
+	if f, ok := c.(Flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// ReadRange reads part of an entry from c, using RangeReader if c implements
+// it. Otherwise it falls back to a full Reader, seeking to the start of the
+// range when the reader is an io.Seeker (such as files from a disk cache) and
+// skipping over the leading bytes when it isn't.
+func ReadRange(ctx context.Context, c Cache, store Store, key Key, offset, length int64) (io.Reader, int64, error) {
+	if rr, ok := c.(RangeReader); ok {
+		return rr.RangeReader(ctx, store, key, offset, length)
+	}
+
+	reader, size, err := c.Reader(ctx, store, key)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	start, n, err := ResolveRange(offset, length, size)
+	if err != nil {
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, size, err
+	}
+
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err = seeker.Seek(start, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, reader, start)
+	}
+	if err != nil {
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, -1, err
+	}
+	return limitReader(reader, n), size, nil
+}
+
+// ResolveRange turns an offset and length as passed to RangeReader into an
+// absolute start and length within an entry of the given size. It returns
+// ErrInvalidRange if the range starts past the end of the entry.
+func ResolveRange(offset, length, size int64) (int64, int64, error) {
+	start := offset
+	if offset < 0 {
+		start = size + offset
+		if start < 0 {
+			start = 0
+		}
+	}
+	if start >= size {
+		return 0, 0, ErrInvalidRange
+	}
+	if length < 0 || start+length > size {
+		length = size - start
+	}
+	return start, length, nil
+}
+
+// limitReader limits reader to n bytes while keeping it closeable.
+func limitReader(reader io.Reader, n int64) io.Reader {
+	limited := &io.LimitedReader{R: reader, N: n}
+	if closer, ok := reader.(io.Closer); ok {
+		return limitedCloser{limited, closer}
+	}
+	return limited
+}
+
+type limitedCloser struct {
+	*io.LimitedReader
+	io.Closer
+}
+
+func (r limitedCloser) Unwrap() io.Reader {
+	return r.LimitedReader
+}
+
+// unwrapReader strips the wrappers a reader picks up on its way through the
+// caches that don't change what's read, so that a file underneath can be
+// sent with sendfile by net/http.
+func unwrapReader(reader io.Reader) io.Reader {
+	for {
+		switch r := reader.(type) {
+		case interface{ Unwrap() io.Reader }:
+			reader = r.Unwrap()
+		case *io.LimitedReader:
+			return &io.LimitedReader{R: unwrapReader(r.R), N: r.N}
+		default:
+			return reader
+		}
+	}
+}
@@ -0,0 +1,622 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	health "github.com/etherlabsio/healthcheck/v2"
+	"github.com/rs/zerolog"
+)
+
+// Options configures a Cache.
+type Options struct {
+	// Self is the address peers reach this member at, as host:port.
+	Self string
+	// Secret is sent with forwarded requests and must match on every peer.
+	Secret string
+	// Token is the admin token of the peers, needed to forward deletes.
+	Token *cache.Token
+	// Replicas is how many members keep a copy of each entry: its owner and
+	// the members that follow it around the ring. It's at least one.
+	Replicas int
+	// Shared is set when the members share their backend, such as an S3
+	// bucket, so that entries are never handed off or repaired. Each member
+	// sees every entry there, and removing one after handing it off would
+	// remove it for everyone.
+	Shared bool
+	// Settle is how long the members must stay the same before a rebalance
+	// removes the entries this member no longer owns, so that a member
+	// flapping in and out of discovery can't take the only copies with it.
+	Settle time.Duration
+}
+
+// Cache routes each key to the members that own it, serving the keys this
+// member owns, and requests forwarded by peers, from the local cache. Writes
+// go to every owner and reads fall back through them in order. Walks only
+// see the local cache.
+type Cache struct {
+	local  cache.Cache
+	opts   Options
+	client *http.Client
+
+	lock    sync.RWMutex
+	ring    *Ring
+	peers   map[string]*peer
+	changed time.Time
+}
+
+var _ cache.Cache = &Cache{}
+
+// New returns a cluster of just this member until SetPeers is called.
+func New(local cache.Cache, opts Options) *Cache {
+	if opts.Replicas < 1 {
+		opts.Replicas = 1
+	}
+	c := &Cache{local: local, opts: opts, client: newClient()}
+	c.SetPeers(nil)
+	return c
+}
+
+// SetPeers changes the members of the cluster, which always include this one.
+// It reports whether they changed.
+func (c *Cache) SetPeers(addrs []string) bool {
+	addrs = append([]string{c.opts.Self}, addrs...)
+	sort.Strings(addrs)
+	var unique []string
+	for _, addr := range addrs {
+		if len(unique) == 0 || unique[len(unique)-1] != addr {
+			unique = append(unique, addr)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.ring != nil && equal(c.ring.Peers(), unique) {
+		return false
+	}
+
+	peers := make(map[string]*peer, len(unique))
+	for _, addr := range unique {
+		if addr == c.opts.Self {
+			continue
+		}
+		if p, ok := c.peers[addr]; ok {
+			peers[addr] = p
+		} else {
+			peers[addr] = &peer{addr: addr, secret: c.opts.Secret, token: c.opts.Token, client: c.client}
+		}
+	}
+	c.ring = NewRing(unique)
+	c.peers = peers
+	c.changed = time.Now()
+	return true
+}
+
+// settled returns the current ring, and whether it has stayed the same for
+// long enough that entries can be removed from members no longer owning them.
+func (c *Cache) settled() (*Ring, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.ring, time.Since(c.changed) >= c.opts.Settle
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Peers returns the members of the cluster, including this one.
+func (c *Cache) Peers() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.ring.Peers()
+}
+
+type forwardedKey struct{}
+
+// Middleware serves requests forwarded by peers from the local cache. Requests
+// that claim to be forwarded without the right secret are treated like any
+// other.
+func (c *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.IsForwarded(r) {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IsForwarded reports whether r was forwarded by a peer.
+func (c *Cache) IsForwarded(r *http.Request) bool {
+	value, ok := r.Header[http.CanonicalHeaderKey(ForwardedHeader)]
+	return ok && len(value) == 1 && subtle.ConstantTimeCompare([]byte(value[0]), []byte(c.opts.Secret)) == 1
+}
+
+// owners returns the caches that hold key, the local cache among them if this
+// member is one of its owners. Forwarded requests are only ever served from
+// the local cache.
+func (c *Cache) owners(ctx context.Context, store cache.Store, key cache.Key) ([]cache.Cache, bool) {
+	if forwarded, _ := ctx.Value(forwardedKey{}).(bool); forwarded {
+		return []cache.Cache{c.local}, true
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	owners := c.ring.Owners(string(store)+"/"+string(key), c.opts.Replicas)
+	caches := make([]cache.Cache, len(owners))
+	self := false
+	for i, owner := range owners {
+		if owner == c.opts.Self {
+			caches[i] = c.local
+			self = true
+		} else {
+			caches[i] = c.peers[owner]
+		}
+	}
+	return caches, self
+}
+
+// readers returns the caches to read key from in order: its owners, then the
+// local cache, which may still have the entry from before its owners joined.
+func (c *Cache) readers(ctx context.Context, store cache.Store, key cache.Key) []cache.Cache {
+	caches, self := c.owners(ctx, store, key)
+	if !self {
+		caches = append(caches, c.local)
+	}
+	return caches
+}
+
+// read calls fn with each cache that may hold key until one of them has it.
+func (c *Cache) read(ctx context.Context, store cache.Store, key cache.Key, fn func(cache.Cache) error) error {
+	var err error
+	for _, from := range c.readers(ctx, store, key) {
+		if err = fn(from); err == nil || ctx.Err() != nil || errors.Is(err, cache.ErrInvalidRange) {
+			return err
+		}
+		if p, ok := from.(*peer); ok && !errors.Is(err, cache.ErrNotFound) {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("peer", p.addr).Msg("peer unavailable")
+		}
+	}
+	return err
+}
+
+func (c *Cache) Exists(ctx context.Context, store cache.Store, key cache.Key) error {
+	return c.read(ctx, store, key, func(from cache.Cache) error {
+		return from.Exists(ctx, store, key)
+	})
+}
+
+func (c *Cache) Stat(ctx context.Context, store cache.Store, key cache.Key) (info cache.Info, err error) {
+	err = c.read(ctx, store, key, func(from cache.Cache) error {
+		info, err = from.Stat(ctx, store, key)
+		return err
+	})
+	return info, err
+}
+
+func (c *Cache) Reader(ctx context.Context, store cache.Store, key cache.Key) (reader io.Reader, size int64, err error) {
+	err = c.read(ctx, store, key, func(from cache.Cache) error {
+		reader, size, err = from.Reader(ctx, store, key)
+		return err
+	})
+	return reader, size, err
+}
+
+var _ cache.RangeReader = &Cache{}
+
+func (c *Cache) RangeReader(ctx context.Context, store cache.Store, key cache.Key, offset, length int64) (reader io.Reader, size int64, err error) {
+	err = c.read(ctx, store, key, func(from cache.Cache) error {
+		reader, size, err = cache.ReadRange(ctx, from, store, key, offset, length)
+		return err
+	})
+	return reader, size, err
+}
+
+// Writer writes to every owner of key at once. The write succeeds as long as
+// one of them stores the entry; any others are left for Repair.
+func (c *Cache) Writer(ctx context.Context, store cache.Store, key cache.Key) (io.Writer, error) {
+	owners, _ := c.owners(ctx, store, key)
+	if len(owners) == 1 {
+		return owners[0].Writer(ctx, store, key)
+	}
+
+	w := &replicaWriter{ctx: ctx}
+	var err error
+	for _, to := range owners {
+		var writer io.Writer
+		if writer, err = to.Writer(ctx, store, key); err != nil {
+			logReplica(ctx, to, err)
+			continue
+		}
+		w.writers = append(w.writers, writer)
+		w.owners = append(w.owners, to)
+	}
+	if len(w.writers) == 0 {
+		return nil, err
+	}
+	return w, nil
+}
+
+func logReplica(ctx context.Context, to cache.Cache, err error) {
+	log := zerolog.Ctx(ctx).Warn().Err(err)
+	if p, ok := to.(*peer); ok {
+		log = log.Str("peer", p.addr)
+	}
+	log.Msg("replica write")
+}
+
+// replicaWriter writes to several owners, dropping any that fail.
+type replicaWriter struct {
+	ctx     context.Context
+	writers []io.Writer
+	owners  []cache.Cache
+}
+
+func (w *replicaWriter) drop(i int, err error) {
+	logReplica(w.ctx, w.owners[i], err)
+	cache.Abort(w.writers[i])
+	w.writers = append(w.writers[:i], w.writers[i+1:]...)
+	w.owners = append(w.owners[:i], w.owners[i+1:]...)
+}
+
+func (w *replicaWriter) Write(p []byte) (int, error) {
+	var err error
+	for i := 0; i < len(w.writers); {
+		if _, err = w.writers[i].Write(p); err != nil {
+			w.drop(i, err)
+			continue
+		}
+		i++
+	}
+	if len(w.writers) == 0 {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *replicaWriter) Close() error {
+	var err error
+	stored := 0
+	for i, writer := range w.writers {
+		closer, ok := writer.(io.Closer)
+		if !ok {
+			stored++
+			continue
+		}
+		if cerr := closer.Close(); cerr != nil {
+			logReplica(w.ctx, w.owners[i], cerr)
+			err = cerr
+		} else {
+			stored++
+		}
+	}
+	if stored > 0 {
+		return nil
+	}
+	return err
+}
+
+var _ cache.Aborter = &replicaWriter{}
+
+func (w *replicaWriter) Abort() error {
+	for _, writer := range w.writers {
+		cache.Abort(writer)
+	}
+	return nil
+}
+
+var _ cache.Deleter = &Cache{}
+
+// Delete removes the entry from every owner and from the local cache, which
+// may still hold it from before its owners joined. It's only not found if
+// none of them had it.
+func (c *Cache) Delete(ctx context.Context, store cache.Store, key cache.Key) error {
+	err := cache.ErrNotFound
+	for _, from := range c.readers(ctx, store, key) {
+		derr := cache.Delete(ctx, from, store, key)
+		if derr == nil {
+			if errors.Is(err, cache.ErrNotFound) {
+				err = nil
+			}
+		} else if !errors.Is(derr, cache.ErrNotFound) {
+			err = derr
+		}
+	}
+	return err
+}
+
+var _ cache.Walker = &Cache{}
+
+func (c *Cache) Walk(ctx context.Context, store cache.Store, fn cache.WalkFunc) error {
+	return cache.Walk(ctx, c.local, store, fn)
+}
+
+var _ cache.SeekWalker = &Cache{}
+
+func (c *Cache) WalkAfter(ctx context.Context, store cache.Store, after cache.Key, fn cache.WalkFunc) error {
+	return cache.WalkAfter(ctx, c.local, store, after, fn)
+}
+
+var _ cache.Flusher = &Cache{}
+
+func (c *Cache) Flush(ctx context.Context) error {
+	return cache.Flush(ctx, c.local)
+}
+
+var _ health.Checker = &Cache{}
+
+// Check only checks the local cache; peers check their own.
+func (c *Cache) Check(ctx context.Context) error {
+	if checker, ok := c.local.(health.Checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+// spread copies every local entry to those of its owners that are missing it.
+// Entries this member doesn't own are then removed locally when keep is
+// false, but only once every owner has confirmed its copy and the members
+// have settled and not changed since. It returns how many copies were made.
+func (c *Cache) spread(ctx context.Context, keep bool) (int, error) {
+	if c.opts.Shared {
+		return 0, nil
+	}
+	ring, settled := c.settled()
+	copied := 0
+	for _, store := range []cache.Store{cache.CAS, cache.AC} {
+		err := cache.Walk(ctx, c.local, store, func(key cache.Key, info cache.Info) error {
+			owners, self := c.owners(ctx, store, key)
+			if self != keep {
+				return nil
+			}
+
+			complete := true
+			for _, to := range owners {
+				p, ok := to.(*peer)
+				if !ok {
+					continue
+				}
+				n, err := c.handOff(ctx, p, store, key)
+				if err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					zerolog.Ctx(ctx).Warn().Err(err).
+						Str("peer", p.addr).
+						Stringer("store", store).
+						Stringer("key", key).
+						Msg("hand off")
+					complete = false
+					continue
+				}
+				copied += n
+			}
+
+			if !keep && complete && settled && c.unchanged(ring) {
+				if err := cache.Delete(ctx, c.local, store, key); err != nil && !errors.Is(err, cache.ErrNotFound) && !errors.Is(err, cache.ErrNotSupported) {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// Rebalance hands the local entries this member no longer owns to their
+// owners and removes them locally once the members have settled. It returns
+// how many copies were made.
+func (c *Cache) Rebalance(ctx context.Context) (int, error) {
+	return c.spread(ctx, false)
+}
+
+// Repair copies the local entries this member owns to the other owners that
+// are missing them, such as a member that lost its disk. It returns how many
+// copies were made.
+func (c *Cache) Repair(ctx context.Context) (int, error) {
+	return c.spread(ctx, true)
+}
+
+func (c *Cache) unchanged(ring *Ring) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.ring == ring
+}
+
+// handOff copies an entry to p unless it already has it, in which case its
+// copy is kept since AC entries can be overwritten and it may be newer. A new
+// copy is only counted once p confirms it has it.
+func (c *Cache) handOff(ctx context.Context, p *peer, store cache.Store, key cache.Key) (int, error) {
+	if err := p.Exists(ctx, store, key); err == nil {
+		return 0, nil
+	} else if !errors.Is(err, cache.ErrNotFound) {
+		return 0, err
+	}
+	if err := copyEntry(ctx, c.local, p, store, key); err != nil {
+		return 0, err
+	}
+	if err := p.Exists(ctx, store, key); err != nil {
+		return 0, fmt.Errorf("copy not confirmed: %w", err)
+	}
+	return 1, nil
+}
+
+func copyEntry(ctx context.Context, from, to cache.Cache, store cache.Store, key cache.Key) error {
+	reader, _, err := from.Reader(ctx, store, key)
+	if err != nil {
+		return err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	writer, err := to.Writer(ctx, store, key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		cache.Abort(writer)
+		return err
+	}
+	if closer, ok := writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Discoverer finds the addresses of the members of a cluster.
+type Discoverer interface {
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// Static is a fixed list of peer addresses.
+type Static []string
+
+func (s Static) Peers(context.Context) ([]string, error) {
+	return s, nil
+}
+
+// DNS finds peers by looking up every address of a name, such as that of a
+// Kubernetes headless service.
+type DNS struct {
+	Name string
+	Port int
+	// Service, if set, is the name of a port whose SRV records are looked up
+	// instead, and peers are named "<host>.<Name>:<port>" after their
+	// hostnames rather than by address. The pods of a Kubernetes StatefulSet
+	// keep those names across restarts, so their keys stay where they are.
+	Service string
+}
+
+func (d DNS) Peers(ctx context.Context) ([]string, error) {
+	if d.Service != "" {
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, d.Service, "tcp", d.Name)
+		if err != nil {
+			return nil, err
+		}
+		peers := make([]string, len(srvs))
+		for i, srv := range srvs {
+			peers[i] = srvPeer(d.Name, srv)
+		}
+		return peers, nil
+	}
+
+	hosts, err := net.DefaultResolver.LookupHost(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]string, len(hosts))
+	for i, host := range hosts {
+		peers[i] = net.JoinHostPort(host, strconv.Itoa(d.Port))
+	}
+	return peers, nil
+}
+
+// srvPeer names the target of an SRV record of name by its hostname under
+// name, whatever domain the record was found in.
+func srvPeer(name string, srv *net.SRV) string {
+	host := strings.TrimSuffix(srv.Target, ".")
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		host = host[:i]
+	}
+	return net.JoinHostPort(host+"."+strings.TrimSuffix(name, "."), strconv.Itoa(int(srv.Port)))
+}
+
+// Run refreshes the members of the cluster from d every interval until ctx is
+// done, rebalancing whenever they change. Entries are handed off straight
+// away, but only removed by another rebalance once the members have settled.
+func (c *Cache) Run(ctx context.Context, d Discoverer, interval time.Duration) {
+	log := zerolog.Ctx(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	rebalance := func() {
+		start := time.Now()
+		copied, err := c.Rebalance(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Err(err).Msg("cluster rebalance")
+		}
+		log.Info().Int("copied", copied).Dur("duration", time.Since(start)).Msg("cluster rebalance")
+	}
+
+	unsettled := false
+	for {
+		peers, err := d.Peers(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Err(err).Msg("cluster discovery")
+			}
+		} else if c.SetPeers(peers) {
+			log.Info().Strs("peers", c.Peers()).Msg("cluster changed")
+			rebalance()
+			unsettled = c.opts.Settle > 0
+		} else if _, settled := c.settled(); unsettled && settled {
+			rebalance()
+			unsettled = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// AntiEntropy runs Repair every interval until ctx is done.
+func (c *Cache) AntiEntropy(ctx context.Context, interval time.Duration) {
+	log := zerolog.Ctx(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		copied, err := c.Repair(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Err(err).Msg("cluster repair")
+		}
+		log.Info().Int("copied", copied).Dur("duration", time.Since(start)).Msg("cluster repair")
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+type member struct {
+	local   cache.Cache
+	cluster *Cache
+	server  *httptest.Server
+}
+
+func newMembers(t *testing.T, n, replicas int) []*member {
+	token := cache.NewToken("token")
+	members := make([]*member, n)
+	var addrs []string
+	for i := range members {
+		m := &member{local: cache.NewMemCache()}
+		var handler http.Handler
+		m.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.ServeHTTP(w, r)
+		}))
+		t.Cleanup(m.server.Close)
+		addr := strings.TrimPrefix(m.server.URL, "http://")
+		m.cluster = New(m.local, Options{Self: addr, Secret: "secret", Token: token, Replicas: replicas})
+		handler = cache.NewServer(addr, m.cluster, cache.WithAdminToken(token), cache.WithMiddleware(m.cluster.Middleware)).Handler
+		members[i] = m
+		addrs = append(addrs, addr)
+	}
+	for _, m := range members {
+		m.cluster.SetPeers(addrs)
+	}
+	return members
+}
+
+func (m *member) owns(store cache.Store, key cache.Key) bool {
+	return m.cluster.ring.Owner(string(store)+"/"+string(key)) == m.cluster.opts.Self
+}
+
+const digest = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+var key = cache.Key(digest[:2] + "/" + digest)
+
+func TestCache(t *testing.T) {
+	assert := assert.New(t)
+	members := newMembers(t, 3, 1)
+
+	req, _ := http.NewRequest(http.MethodPut, members[0].server.URL+"/cas/"+digest, bytes.NewReader([]byte("test")))
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+	}
+
+	// the entry is stored by its owner alone, and every member can read it
+	for _, m := range members {
+		err := m.local.Exists(context.Background(), cache.CAS, key)
+		if m.owns(cache.CAS, key) {
+			assert.NoError(err)
+		} else {
+			assert.True(errors.Is(err, cache.ErrNotFound))
+		}
+
+		resp, err := http.Get(m.server.URL + "/cas/" + digest)
+		if assert.NoError(err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(http.StatusOK, resp.StatusCode)
+			assert.Equal("test", string(body))
+		}
+	}
+
+	// requests claiming to be forwarded need the secret
+	req, _ = http.NewRequest(http.MethodGet, members[0].server.URL+"/cas/"+digest, nil)
+	assert.False(members[0].cluster.IsForwarded(req))
+	req.Header.Set(ForwardedHeader, "wrong")
+	assert.False(members[0].cluster.IsForwarded(req))
+	req.Header.Set(ForwardedHeader, "secret")
+	assert.True(members[0].cluster.IsForwarded(req))
+
+	for _, m := range members {
+		if !m.owns(cache.CAS, key) {
+			assert.NoError(m.cluster.Delete(context.Background(), cache.CAS, key))
+			break
+		}
+	}
+	for _, m := range members {
+		assert.True(errors.Is(m.local.Exists(context.Background(), cache.CAS, key), cache.ErrNotFound))
+	}
+}
+
+func TestCacheRebalance(t *testing.T) {
+	assert := assert.New(t)
+	members := newMembers(t, 2, 1)
+	ctx := context.Background()
+
+	// an entry written before the cluster formed
+	var holder, owner *member
+	for _, m := range members {
+		if m.owns(cache.CAS, key) {
+			owner = m
+		} else {
+			holder = m
+		}
+	}
+	w, _ := holder.local.Writer(ctx, cache.CAS, key)
+	w.Write([]byte("test"))
+	w.(interface{ Close() error }).Close()
+
+	// reads fall back to the local cache until it's moved
+	r, _, err := holder.cluster.Reader(ctx, cache.CAS, key)
+	if assert.NoError(err) {
+		b, _ := ioutil.ReadAll(r)
+		assert.Equal("test", string(b))
+	}
+
+	moved, err := holder.cluster.Rebalance(ctx)
+	assert.NoError(err)
+	assert.Equal(1, moved)
+	assert.True(errors.Is(holder.local.Exists(ctx, cache.CAS, key), cache.ErrNotFound))
+	assert.NoError(owner.local.Exists(ctx, cache.CAS, key))
+
+	moved, err = owner.cluster.Rebalance(ctx)
+	assert.NoError(err)
+	assert.Equal(0, moved)
+
+	// until the members settle, entries are handed off but kept
+	w, _ = holder.local.Writer(ctx, cache.CAS, key)
+	w.Write([]byte("test"))
+	w.(interface{ Close() error }).Close()
+	assert.NoError(cache.Delete(ctx, owner.local, cache.CAS, key))
+	holder.cluster.opts.Settle = time.Hour
+	moved, err = holder.cluster.Rebalance(ctx)
+	assert.NoError(err)
+	assert.Equal(1, moved)
+	assert.NoError(holder.local.Exists(ctx, cache.CAS, key))
+	assert.NoError(owner.local.Exists(ctx, cache.CAS, key))
+
+	holder.cluster.changed = time.Now().Add(-time.Hour)
+	moved, err = holder.cluster.Rebalance(ctx)
+	assert.NoError(err)
+	assert.Equal(0, moved)
+	assert.True(errors.Is(holder.local.Exists(ctx, cache.CAS, key), cache.ErrNotFound))
+
+	// members sharing a backend leave their entries where they are
+	w, _ = holder.local.Writer(ctx, cache.CAS, key)
+	w.Write([]byte("test"))
+	w.(interface{ Close() error }).Close()
+	holder.cluster.opts.Shared = true
+	moved, err = holder.cluster.Rebalance(ctx)
+	assert.NoError(err)
+	assert.Equal(0, moved)
+	assert.NoError(holder.local.Exists(ctx, cache.CAS, key))
+}
+
+func TestCacheReplicas(t *testing.T) {
+	assert := assert.New(t)
+	members := newMembers(t, 3, 2)
+	ctx := context.Background()
+
+	w, err := members[0].cluster.Writer(ctx, cache.CAS, key)
+	if assert.NoError(err) {
+		w.Write([]byte("test"))
+		assert.NoError(w.(interface{ Close() error }).Close())
+	}
+
+	var owners []*member
+	for _, m := range members {
+		if m.local.Exists(ctx, cache.CAS, key) == nil {
+			owners = append(owners, m)
+		}
+	}
+	if !assert.Len(owners, 2) {
+		return
+	}
+
+	// losing a copy falls back to the other one until it's repaired
+	assert.NoError(cache.Delete(ctx, owners[0].local, cache.CAS, key))
+	for _, m := range members {
+		r, _, err := m.cluster.Reader(ctx, cache.CAS, key)
+		if assert.NoError(err) {
+			b, _ := ioutil.ReadAll(r)
+			assert.Equal("test", string(b))
+		}
+	}
+
+	copied, err := owners[1].cluster.Repair(ctx)
+	assert.NoError(err)
+	assert.Equal(1, copied)
+	assert.NoError(owners[0].local.Exists(ctx, cache.CAS, key))
+
+	copied, err = owners[0].cluster.Repair(ctx)
+	assert.NoError(err)
+	assert.Equal(0, copied)
+}
+
+func TestSRVPeer(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := &net.SRV{Target: "buzzel-0.buzzel-headless.default.svc.cluster.local.", Port: 8080}
+	assert.Equal("buzzel-0.buzzel-headless.default.svc:8080", srvPeer("buzzel-headless.default.svc", srv))
+	assert.Equal("buzzel-0.buzzel-headless.default.svc:8080", srvPeer("buzzel-headless.default.svc.", srv))
+}
@@ -0,0 +1,218 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+)
+
+// ForwardedHeader marks requests forwarded by a peer, which are served from
+// the local cache rather than forwarded again. Its value is the cluster
+// secret.
+const ForwardedHeader = "X-Buzzel-Forwarded"
+
+// peer is the cache of another member of the cluster, reached over HTTP.
+type peer struct {
+	addr   string
+	secret string
+	token  *cache.Token
+	client *http.Client
+}
+
+var _ cache.Cache = &peer{}
+
+func (p *peer) url(store cache.Store, key cache.Key) string {
+	return "http://" + p.addr + "/" + string(store) + "/" + path.Base(string(key))
+}
+
+func (p *peer) request(ctx context.Context, method string, store cache.Store, key cache.Key, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.url(store, key), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ForwardedHeader, p.secret)
+	// ask for the entry as it's stored so that sizes are exact
+	req.Header.Set("Accept-Encoding", "identity")
+	return req, nil
+}
+
+func (p *peer) do(req *http.Request, ok ...int) (*http.Response, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, cache.ErrNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, cache.ErrInvalidRange
+	}
+	return nil, fmt.Errorf("peer %s: %s %s: %s", p.addr, req.Method, req.URL.Path, resp.Status)
+}
+
+func (p *peer) Exists(ctx context.Context, store cache.Store, key cache.Key) error {
+	_, err := p.Stat(ctx, store, key)
+	return err
+}
+
+func (p *peer) Stat(ctx context.Context, store cache.Store, key cache.Key) (cache.Info, error) {
+	req, err := p.request(ctx, http.MethodHead, store, key, nil)
+	if err != nil {
+		return cache.Info{}, err
+	}
+	resp, err := p.do(req, http.StatusOK)
+	if err != nil {
+		return cache.Info{}, err
+	}
+	resp.Body.Close()
+
+	info := cache.Info{Size: resp.ContentLength}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info, nil
+}
+
+func (p *peer) Reader(ctx context.Context, store cache.Store, key cache.Key) (io.Reader, int64, error) {
+	req, err := p.request(ctx, http.MethodGet, store, key, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	resp, err := p.do(req, http.StatusOK)
+	if err != nil {
+		return nil, -1, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+var _ cache.RangeReader = &peer{}
+
+func (p *peer) RangeReader(ctx context.Context, store cache.Store, key cache.Key, offset, length int64) (io.Reader, int64, error) {
+	req, err := p.request(ctx, http.MethodGet, store, key, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	switch {
+	case offset < 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d", offset))
+	case length < 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	default:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+
+	resp, err := p.do(req, http.StatusPartialContent)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	// Content-Range looks like "bytes 0-99/200"
+	size := int64(-1)
+	if cr := resp.Header.Get("Content-Range"); cr != "" {
+		if i := strings.LastIndexByte(cr, '/'); i >= 0 {
+			size, _ = strconv.ParseInt(cr[i+1:], 10, 64)
+		}
+	}
+	return resp.Body, size, nil
+}
+
+// Writer streams the entry to the peer as it's written. Close waits for the
+// peer to store it.
+func (p *peer) Writer(ctx context.Context, store cache.Store, key cache.Key) (io.Writer, error) {
+	pr, pw := io.Pipe()
+	req, err := p.request(ctx, http.MethodPut, store, key, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &peerWriter{PipeWriter: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := p.do(req, http.StatusOK)
+		if err == nil {
+			resp.Body.Close()
+		}
+		// unblock writes if the peer gave up early
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+var errAborted = errors.New("cluster: upload aborted")
+
+type peerWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *peerWriter) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+var _ cache.Aborter = &peerWriter{}
+
+func (w *peerWriter) Abort() error {
+	w.CloseWithError(errAborted)
+	<-w.done
+	return nil
+}
+
+var _ cache.Deleter = &peer{}
+
+func (p *peer) Delete(ctx context.Context, store cache.Store, key cache.Key) error {
+	req, err := p.request(ctx, http.MethodDelete, store, key, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token.Get())
+	resp, err := p.do(req, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// newClient returns the client used to talk to peers. There's no overall
+// timeout since entries can be large; requests are bounded by their context.
+func newClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost:   64,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+	}
+}
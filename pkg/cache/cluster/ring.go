@@ -0,0 +1,114 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cluster spreads a cache across peers, routing each key to the peer
+// that owns it.
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// vnodes is how many points each peer gets on the ring, which evens out how
+// many keys each of them owns.
+const vnodes = 128
+
+// Ring assigns keys to peers by consistent hashing, so that adding or
+// removing a peer only moves the keys it gains or loses.
+type Ring struct {
+	peers  []string
+	points []uint64
+	owners map[uint64]string
+}
+
+// hash is FNV-64a followed by murmur3's finalizer, since FNV alone clusters
+// the points of similar names on the ring.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb53a185ec16b
+	x ^= x >> 33
+	return x
+}
+
+func NewRing(peers []string) *Ring {
+	r := &Ring{owners: make(map[uint64]string, len(peers)*vnodes)}
+	r.peers = append(r.peers, peers...)
+	sort.Strings(r.peers)
+	for _, peer := range r.peers {
+		for i := 0; i < vnodes; i++ {
+			point := hash(peer + "#" + strconv.Itoa(i))
+			if _, ok := r.owners[point]; ok {
+				// the peer that sorts first keeps a collision
+				continue
+			}
+			r.owners[point] = peer
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Peers returns the peers on the ring in sorted order.
+func (r *Ring) Peers() []string {
+	return r.peers
+}
+
+// Owners returns up to n distinct peers for key, the owner first and then the
+// peers that follow it around the ring.
+func (r *Ring) Owners(key string, n int) []string {
+	if len(r.points) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.peers) {
+		n = len(r.peers)
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	owners := make([]string, 0, n)
+	for j := 0; j < len(r.points) && len(owners) < n; j++ {
+		peer := r.owners[r.points[(i+j)%len(r.points)]]
+		if !contains(owners, peer) {
+			owners = append(owners, peer)
+		}
+	}
+	return owners
+}
+
+// Owner returns the peer that owns key, or nothing if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if owners := r.Owners(key, 1); len(owners) > 0 {
+		return owners[0]
+	}
+	return ""
+}
+
+func contains(peers []string, peer string) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
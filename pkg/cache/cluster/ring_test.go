@@ -0,0 +1,57 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", NewRing(nil).Owner("foo"))
+
+	peers := []string{"c:8080", "a:8080", "b:8080"}
+	ring := NewRing(peers)
+	assert.Equal([]string{"a:8080", "b:8080", "c:8080"}, ring.Peers())
+
+	owned := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := strconv.Itoa(i)
+		owners[key] = ring.Owner(key)
+		owned[owners[key]]++
+
+		replicas := ring.Owners(key, 5)
+		assert.Len(replicas, 3)
+		assert.Equal(owners[key], replicas[0])
+		assert.ElementsMatch(peers, replicas)
+	}
+	for _, peer := range peers {
+		assert.InDelta(1000, owned[peer], 300, peer)
+	}
+
+	// only the keys the new peer takes over move
+	ring = NewRing(append(peers, "d:8080"))
+	for key, owner := range owners {
+		if moved := ring.Owner(key); moved != owner {
+			assert.Equal("d:8080", moved, key)
+		}
+	}
+}
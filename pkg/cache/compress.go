@@ -0,0 +1,316 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The content codings responses can be compressed with.
+const (
+	Zstd   = "zstd"
+	Brotli = "br"
+	Gzip   = "gzip"
+)
+
+// CompressOptions configures how entries are compressed for clients that
+// accept it.
+type CompressOptions struct {
+	// Encodings are the content codings to offer, most preferred first.
+	Encodings []string
+	// Only entries of at least MinSize bytes, and no more than MaxSize unless
+	// it's zero, are compressed. Entries are compressed in memory.
+	MinSize int64
+	MaxSize int64
+	// MaxRatio is how large a sample of an entry may be once compressed,
+	// relative to its size, for the entry to be worth compressing.
+	MaxRatio float64
+	// CacheSize is how many bytes of compressed CAS blobs are kept, along
+	// with which blobs aren't worth compressing. AC entries can change so
+	// they're compressed every time.
+	CacheSize int64
+	// Memory is how many bytes the entries being compressed, and their
+	// compressed copies, may take up at once. Entries that don't fit are sent
+	// as they are. Unlimited when zero.
+	Memory int64
+}
+
+// ValidEncoding reports whether responses can be compressed with enc.
+func ValidEncoding(enc string) error {
+	switch enc {
+	case Zstd, Brotli, Gzip:
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %q", enc)
+}
+
+// sampleSize is how much of an entry is looked at to decide whether it's
+// worth compressing.
+const sampleSize = 64 << 10
+
+// incompressible are the types sniffed by net/http that are compressed
+// already.
+var incompressible = map[string]bool{
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/x-rar-compressed": true,
+	"application/wasm":             true,
+	"image/gif":                    true,
+	"image/jpeg":                   true,
+	"image/png":                    true,
+	"image/webp":                   true,
+	"audio/mpeg":                   true,
+	"video/mp4":                    true,
+	"video/webm":                   true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// compressor compresses entries for the handlers and remembers the results
+// for CAS blobs, which never change.
+type compressor struct {
+	opts CompressOptions
+	zstd *zstd.Encoder
+
+	lock sync.Mutex
+	ll   *list.List
+	mp   map[string]*list.Element
+	size int64
+	// inflight is how much of Memory is taken
+	inflight int64
+}
+
+// variant is a compressed blob, or a blob that isn't worth compressing when
+// data is nil.
+type variant struct {
+	name string
+	data []byte
+}
+
+func newCompressor(opts CompressOptions) *compressor {
+	// EncodeAll is safe to call concurrently
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	return &compressor{opts: opts, zstd: enc, ll: list.New(), mp: make(map[string]*list.Element)}
+}
+
+// negotiate picks the most preferred encoding accepted by an Accept-Encoding
+// header, if any.
+func (c *compressor) negotiate(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		coding, q := part, 1.0
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			coding = part[:i]
+			param := strings.TrimSpace(part[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = q > 0
+	}
+
+	for _, enc := range c.opts.Encodings {
+		if ok, listed := accepted[enc]; ok || (!listed && accepted["*"]) {
+			return enc
+		}
+	}
+	return ""
+}
+
+// eligible reports whether an entry of size bytes may be compressed.
+func (c *compressor) eligible(size int64) bool {
+	return size >= c.opts.MinSize && (c.opts.MaxSize <= 0 || size <= c.opts.MaxSize)
+}
+
+func (c *compressor) lookup(name string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.mp[name]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*variant).data, true
+}
+
+// cost is how much a variant counts against CacheSize. Blobs that aren't
+// worth compressing cost a little so that there's a limit to them too.
+func cost(v *variant) int64 {
+	return int64(len(v.name) + len(v.data) + 64)
+}
+
+func (c *compressor) remember(name string, data []byte) {
+	v := &variant{name: name, data: data}
+	if cost(v) > c.opts.CacheSize {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.mp[name]; ok {
+		c.size -= cost(el.Value.(*variant))
+		c.ll.Remove(el)
+	}
+	for c.size+cost(v) > c.opts.CacheSize {
+		el := c.ll.Back()
+		old := el.Value.(*variant)
+		c.ll.Remove(el)
+		delete(c.mp, old.name)
+		c.size -= cost(old)
+	}
+	c.mp[name] = c.ll.PushFront(v)
+	c.size += cost(v)
+}
+
+// worthwhile reports whether an entry that starts with sample is worth
+// compressing: it isn't of a type that's compressed already and the sample
+// shrinks by enough.
+func (c *compressor) worthwhile(sample []byte) bool {
+	if incompressible[http.DetectContentType(sample)] {
+		return false
+	}
+	compressed := c.zstd.EncodeAll(sample, make([]byte, 0, len(sample)))
+	return float64(len(compressed)) <= float64(len(sample))*c.opts.MaxRatio
+}
+
+func (c *compressor) encode(enc string, data []byte) ([]byte, error) {
+	if enc == Zstd {
+		return c.zstd.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	}
+
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch enc {
+	case Brotli:
+		w = brotli.NewWriterLevel(buf, 5)
+	case Gzip:
+		w, _ = gzip.NewWriterLevel(buf, gzip.DefaultCompression)
+	default:
+		return nil, ValidEncoding(enc)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// reserve takes n bytes of Memory until release is called, unless they don't
+// fit.
+func (c *compressor) reserve(n int64) (release func(), ok bool) {
+	if c.opts.Memory <= 0 {
+		return func() {}, true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.inflight+n > c.opts.Memory {
+		return nil, false
+	}
+	c.inflight += n
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.inflight -= n
+	}, true
+}
+
+func noRelease() {}
+
+// compress returns an entry of size bytes read from reader compressed with
+// enc, or nil if it isn't worth compressing, in which case the reader
+// returned reads the whole entry. Either may be held in memory, which is
+// counted against Memory until release is called.
+func (c *compressor) compress(store Store, key Key, reader io.Reader, size int64, enc string) (compressed []byte, rest io.Reader, release func(), err error) {
+	name := resolve(store, key)
+	cacheable := store == CAS && c.opts.CacheSize > 0
+	if cacheable {
+		if data, ok := c.lookup(name + ";" + enc); ok {
+			return data, nil, noRelease, nil
+		}
+		if _, ok := c.lookup(name); ok {
+			return nil, reader, noRelease, nil
+		}
+	}
+
+	n := size
+	if n > sampleSize {
+		n = sampleSize
+	}
+	sample := make([]byte, n)
+	if _, err := io.ReadFull(reader, sample); err != nil {
+		return nil, nil, nil, err
+	}
+	if !c.worthwhile(sample) {
+		if cacheable {
+			c.remember(name, nil)
+		}
+		return nil, rewind(reader, sample), noRelease, nil
+	}
+
+	// the entry and, at worst, a compressed copy as large
+	release, ok := c.reserve(2 * size)
+	if !ok {
+		return nil, rewind(reader, sample), noRelease, nil
+	}
+	data := make([]byte, size)
+	copy(data, sample)
+	if _, err := io.ReadFull(reader, data[n:]); err != nil {
+		release()
+		return nil, nil, nil, err
+	}
+	compressed, err = c.encode(enc, data)
+	if err != nil {
+		release()
+		return nil, nil, nil, err
+	}
+	if len(compressed) >= len(data) {
+		if cacheable {
+			c.remember(name, nil)
+		}
+		return nil, bytes.NewReader(data), release, nil
+	}
+	if cacheable {
+		c.remember(name+";"+enc, compressed)
+	}
+	return compressed, nil, release, nil
+}
+
+// rewind returns a reader of everything read from reader, starting with
+// sample. Files are seeked back so that they can still be sent with
+// sendfile.
+func rewind(reader io.Reader, sample []byte) io.Reader {
+	if seeker, ok := unwrapReader(reader).(io.Seeker); ok {
+		if _, err := seeker.Seek(-int64(len(sample)), io.SeekCurrent); err == nil {
+			return reader
+		}
+	}
+	return io.MultiReader(bytes.NewReader(sample), reader)
+}
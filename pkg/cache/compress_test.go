@@ -0,0 +1,192 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	sha "crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressorNegotiate(t *testing.T) {
+	assert := assert.New(t)
+	c := newCompressor(CompressOptions{Encodings: []string{Zstd, Brotli, Gzip}})
+	specs := map[string]string{
+		"":                    "",
+		"identity":            "",
+		"gzip":                Gzip,
+		"gzip, br":            Brotli,
+		"gzip, br, zstd":      Zstd,
+		"zstd;q=0, gzip;q=.5": Gzip,
+		"*":                   Zstd,
+		"*, zstd;q=0":         Brotli,
+	}
+	for header, enc := range specs {
+		assert.Equal(enc, c.negotiate(header), header)
+	}
+}
+
+func decode(enc string, body []byte) ([]byte, error) {
+	var r io.Reader
+	switch enc {
+	case Zstd:
+		d, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		r = d
+	case Brotli:
+		r = brotli.NewReader(bytes.NewReader(body))
+	case Gzip:
+		g, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r = g
+	default:
+		return body, nil
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestHandlerCompression(t *testing.T) {
+	assert := assert.New(t)
+	text := []byte(strings.Repeat("all work and no play makes jack a dull boy\n", 1000))
+	random := make([]byte, 32<<10)
+	rand.Read(random)
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	gw.Write(text)
+	gw.Close()
+
+	c := NewMemCache()
+	h := &handler{Cache: c, store: CAS, compress: newCompressor(CompressOptions{
+		Encodings: []string{Zstd, Brotli, Gzip},
+		MinSize:   1024,
+		MaxSize:   1 << 20,
+		MaxRatio:  0.9,
+		CacheSize: 1 << 20,
+	})}
+	put := func(data []byte) string {
+		sum := sha.Sum256(data)
+		digest := hex.EncodeToString(sum[:])
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/cas/"+digest, bytes.NewReader(data)))
+		return digest
+	}
+	get := func(digest, accept, rng string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/cas/"+digest, nil)
+		req.Header.Set("Accept-Encoding", accept)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	textSha := put(text)
+	for _, enc := range []string{Zstd, Brotli, Gzip} {
+		for i := 0; i < 2; i++ {
+			resp := get(textSha, enc, "")
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(enc, resp.Header.Get("Content-Encoding"))
+			assert.Equal("Accept-Encoding", resp.Header.Get("Vary"))
+			assert.Equal(`W/"`+textSha+`"`, resp.Header.Get("ETag"))
+			assert.Equal(int64(len(body)), resp.ContentLength)
+			assert.Less(len(body), len(text))
+			decoded, err := decode(enc, body)
+			assert.NoError(err)
+			assert.Equal(text, decoded)
+		}
+	}
+	_, ok := h.compress.lookup(resolve(CAS, Key(textSha[:2]+"/"+textSha)) + ";" + Zstd)
+	assert.True(ok)
+
+	// entries that don't compress, ranges and entries that are too small are
+	// sent as they are
+	specs := []struct {
+		data []byte
+		rng  string
+	}{
+		{random, ""},
+		{gzipped.Bytes(), ""},
+		{text, "bytes=0-99"},
+		{text[:100], ""},
+	}
+	for _, s := range specs {
+		resp := get(put(s.data), "zstd, br, gzip", s.rng)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal("", resp.Header.Get("Content-Encoding"))
+		if s.rng == "" {
+			assert.Equal(s.data, body)
+		} else {
+			assert.Equal(s.data[:100], body)
+		}
+	}
+	// and what doesn't compress is remembered
+	digest := put(random)
+	_, ok = h.compress.lookup(resolve(CAS, Key(digest[:2]+"/"+digest)))
+	assert.True(ok)
+
+	// entries are sent as they are while there's no memory left to compress
+	// them in, and the memory is given back after
+	h.compress.opts.CacheSize = 0
+	h.compress.opts.Memory = int64(len(text))
+	release, ok := h.compress.reserve(1)
+	assert.True(ok)
+	resp := get(textSha, Zstd, "")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal("", resp.Header.Get("Content-Encoding"))
+	assert.Equal(text, body)
+	release()
+	h.compress.opts.Memory = int64(2 * len(text))
+	resp = get(textSha, Zstd, "")
+	assert.Equal(Zstd, resp.Header.Get("Content-Encoding"))
+	assert.Equal(int64(0), h.compress.inflight)
+}
+
+func TestCompressorCache(t *testing.T) {
+	assert := assert.New(t)
+	c := newCompressor(CompressOptions{CacheSize: 300})
+	c.remember("a", make([]byte, 100))
+	c.remember("b", make([]byte, 100))
+	c.remember("c", nil)
+	_, ok := c.lookup("a")
+	assert.False(ok)
+	_, ok = c.lookup("b")
+	assert.True(ok)
+	_, ok = c.lookup("c")
+	assert.True(ok)
+	assert.LessOrEqual(c.size, int64(300))
+
+	// too large to keep at all
+	c.remember("d", make([]byte, 300))
+	_, ok = c.lookup("d")
+	assert.False(ok)
+}
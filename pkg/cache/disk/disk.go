@@ -21,6 +21,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/dmorgan81/buzzel/pkg/cache"
 	health "github.com/etherlabsio/healthcheck/v2"
@@ -56,6 +57,24 @@ func (c Cache) Exists(ctx context.Context, store cache.Store, key cache.Key) err
 	return nil
 }
 
+func (c Cache) Stat(ctx context.Context, store cache.Store, key cache.Key) (cache.Info, error) {
+	path := c.resolve(store, key)
+	log := zerolog.Ctx(ctx).With().Caller().Logger()
+	log.Debug().Str("path", path).Send()
+
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache.Info{}, cache.ErrNotFound
+	} else if err != nil {
+		return cache.Info{}, err
+	}
+
+	if info.IsDir() {
+		return cache.Info{}, ErrKeyIsDir
+	}
+	return cache.Info{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
 func (c Cache) Reader(ctx context.Context, store cache.Store, key cache.Key) (io.Reader, int64, error) {
 	path := c.resolve(store, key)
 	log := zerolog.Ctx(ctx).With().Caller().Logger()
@@ -88,7 +107,111 @@ func (c Cache) Writer(ctx context.Context, store cache.Store, key cache.Key) (io
 		return nil, err
 	}
 
-	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	file, err := os.CreateTemp(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &writer{File: file, path: path, replaced: -1}, nil
+}
+
+// tempPrefix marks files still being written, which walks skip.
+const tempPrefix = ".tmp-"
+
+// writer writes to a temporary file that's only moved into place on Close, so
+// that readers never see a partial entry.
+type writer struct {
+	*os.File
+	path     string
+	replaced int64
+}
+
+func (w *writer) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	if info, err := os.Lstat(w.path); err == nil && info.Mode().IsRegular() {
+		w.replaced = info.Size()
+	}
+	if err := os.Rename(w.File.Name(), w.path); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return nil
+}
+
+var _ cache.Replacer = &writer{}
+
+func (w *writer) Replaced() int64 {
+	return w.replaced
+}
+
+var _ cache.Aborter = &writer{}
+
+func (w *writer) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+var _ cache.Deleter = Cache("")
+
+func (c Cache) Delete(ctx context.Context, store cache.Store, key cache.Key) error {
+	path := c.resolve(store, key)
+	log := zerolog.Ctx(ctx).With().Caller().Logger()
+	log.Debug().Str("path", path).Send()
+
+	if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		return cache.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+var _ cache.Walker = Cache("")
+
+func (c Cache) Walk(ctx context.Context, store cache.Store, fn cache.WalkFunc) error {
+	return c.WalkAfter(ctx, store, "", fn)
+}
+
+var _ cache.SeekWalker = Cache("")
+
+// WalkAfter skips whole directories whose keys all sort before after.
+func (c Cache) WalkAfter(ctx context.Context, store cache.Store, after cache.Key, fn cache.WalkFunc) error {
+	root := filepath.Join(string(c), string(store))
+	if _, err := os.Stat(root); errors.Is(err, os.ErrNotExist) {
+		// nothing has been written to the store yet
+		return nil
+	}
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			// removed since its directory was read
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key := cache.Key(filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			if prefix := key + "/"; rel != "." && prefix < after && !strings.HasPrefix(string(after), string(prefix)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), tempPrefix) || key <= after {
+			return nil
+		}
+		return fn(key, cache.Info{Size: info.Size(), ModTime: info.ModTime()})
+	})
 }
 
 var _ health.Checker = Cache("")
@@ -0,0 +1,138 @@
+/*
+Copyright © 2021 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package disk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	c := Cache(t.TempDir())
+
+	walk := func() []cache.Key {
+		var keys []cache.Key
+		assert.NoError(c.Walk(ctx, cache.CAS, func(key cache.Key, _ cache.Info) error {
+			keys = append(keys, key)
+			return nil
+		}))
+		return keys
+	}
+
+	w, err := c.Writer(ctx, cache.CAS, "ab/abc")
+	assert.NoError(err)
+	w.Write([]byte("foo"))
+	// nothing is visible until the writer is closed
+	assert.ErrorIs(c.Exists(ctx, cache.CAS, "ab/abc"), cache.ErrNotFound)
+	assert.Empty(walk())
+	assert.NoError(w.(io.Closer).Close())
+	info, err := c.Stat(ctx, cache.CAS, "ab/abc")
+	assert.NoError(err)
+	assert.Equal(int64(3), info.Size)
+
+	w, _ = c.Writer(ctx, cache.CAS, "ab/abc")
+	w.Write([]byte("truncated"))
+	assert.NoError(cache.Abort(w))
+	info, _ = c.Stat(ctx, cache.CAS, "ab/abc")
+	assert.Equal(int64(3), info.Size)
+	assert.Equal([]cache.Key{"ab/abc"}, walk())
+}
+
+// hiddenCache hides the files of a cache from the server, so that entries
+// have to be copied through user space.
+type hiddenCache struct {
+	cache.Cache
+}
+
+func (c hiddenCache) Reader(ctx context.Context, store cache.Store, key cache.Key) (io.Reader, int64, error) {
+	reader, size, err := c.Cache.Reader(ctx, store, key)
+	if err != nil {
+		return nil, -1, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, reader.(io.Closer)}, size, nil
+}
+
+func BenchmarkServeLargeBlob(b *testing.B) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(level)
+
+	ctx := context.Background()
+	c := Cache(b.TempDir())
+	blob := bytes.Repeat([]byte("buzzel"), 64<<20/6)
+	sum := sha256.Sum256(blob)
+	digest := hex.EncodeToString(sum[:])
+
+	w, _ := c.Writer(ctx, cache.CAS, cache.Key(digest[:2]+"/"+digest))
+	w.Write(blob)
+	if err := w.(io.Closer).Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	// serve through the same wrappers as the server does for a disk cache,
+	// with an LRU too small to hold the blob
+	serve := func(c cache.Cache) *httptest.Server {
+		stats := cache.NewStats(c)
+		var wrapped cache.Cache = cache.NewTimeout(stats, cache.Timeouts{Exists: time.Minute, Read: time.Minute, Write: time.Minute})
+		wrapped = cache.NewLRUCache(wrapped, int64(len(blob)/2))
+		wrapped = cache.NewTTLCache(wrapped, map[cache.Store]time.Duration{cache.AC: 24 * time.Hour, cache.CAS: 24 * time.Hour})
+		return httptest.NewServer(cache.NewServer("", wrapped, cache.WithStats(stats)).Handler)
+	}
+
+	for _, bc := range []struct {
+		name  string
+		cache cache.Cache
+	}{
+		{"sendfile", c},
+		{"copy", hiddenCache{c}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			s := serve(bc.cache)
+			defer s.Close()
+
+			b.SetBytes(int64(len(blob)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(s.URL + "/cas/" + digest)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, _ := io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				if n != int64(len(blob)) {
+					b.Fatalf("read %d bytes, want %d", n, len(blob))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gc removes CAS blobs that no AC entry refers to.
+package gc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/reapi"
+	"github.com/rs/zerolog"
+)
+
+type Options struct {
+	// Grace protects blobs modified more recently than this. Bazel uploads
+	// outputs to the CAS before the AC entry that refers to them, so without
+	// it blobs of in-flight builds would be collected.
+	Grace time.Duration
+	// DryRun reports what would be deleted without deleting anything.
+	DryRun bool
+	// Front, if set, is the cache in front of the one collected, such as an
+	// in-memory LRU that collecting shouldn't fill with cold entries. Blobs
+	// are deleted through it so that it doesn't keep serving them.
+	Front cache.Cache
+}
+
+type Report struct {
+	ACEntries         int   `json:"acEntries"`
+	Undecodable       int   `json:"undecodable"`
+	Referenced        int   `json:"referenced"`
+	CASEntries        int   `json:"casEntries"`
+	CASBytes          int64 `json:"casBytes"`
+	Unreferenced      int   `json:"unreferenced"`
+	UnreferencedBytes int64 `json:"unreferencedBytes"`
+	Deleted           int   `json:"deleted"`
+	DeletedBytes      int64 `json:"deletedBytes"`
+	// DryRun is set when nothing was actually deleted, either as asked or
+	// because some AC entries were undecodable.
+	DryRun bool `json:"dryRun"`
+}
+
+type collector struct {
+	cache  cache.Cache
+	marked map[string]struct{}
+	// walked holds the Directory messages whose contents have been marked
+	walked map[string]struct{}
+	log    zerolog.Logger
+}
+
+func hashKey(hash string) cache.Key {
+	return cache.Key(hash[:2] + "/" + hash)
+}
+
+func (c *collector) read(ctx context.Context, store cache.Store, key cache.Key) ([]byte, error) {
+	reader, _, err := c.cache.Reader(ctx, store, key)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, reader); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *collector) mark(digests []reapi.Digest) {
+	for _, d := range digests {
+		if len(d.Hash) > 2 {
+			c.marked[d.Hash] = struct{}{}
+		}
+	}
+}
+
+// markAction marks every blob the AC entry at key refers to, including the
+// contents of its output directories. It fails with reapi.ErrMalformed if the
+// entry, or one of the messages describing its output directories, can't be
+// decoded, since the blobs it refers to can't all be marked.
+func (c *collector) markAction(ctx context.Context, key cache.Key) error {
+	log := c.log.With().Stringer("key", key).Logger()
+	data, err := c.read(ctx, cache.AC, key)
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	ar, err := reapi.DecodeActionResult(data)
+	if err != nil {
+		log.Warn().Err(err).Msg("gc undecodable action result")
+		return err
+	}
+	c.mark(ar.Files)
+	c.mark(ar.Directories)
+	c.mark(ar.Trees)
+
+	for _, d := range ar.Trees {
+		if len(d.Hash) <= 2 {
+			continue
+		}
+		data, err := c.read(ctx, cache.CAS, hashKey(d.Hash))
+		if errors.Is(err, cache.ErrNotFound) {
+			log.Debug().Str("tree", d.Hash).Msg("gc missing tree")
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		tree, err := reapi.DecodeTree(data)
+		if err != nil {
+			log.Warn().Err(err).Str("tree", d.Hash).Msg("gc undecodable tree")
+			return err
+		}
+		c.mark(tree.Files)
+		c.mark(tree.Directories)
+	}
+
+	// an output directory may come with only its root Directory, whose
+	// subdirectories are Directory messages of their own rather than being
+	// inlined in a Tree
+	for _, d := range ar.Directories {
+		if err := c.markDirectory(ctx, log, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markDirectory marks the contents of the Directory root and of every
+// Directory below it.
+func (c *collector) markDirectory(ctx context.Context, log zerolog.Logger, root reapi.Digest) error {
+	pending := []reapi.Digest{root}
+	for len(pending) > 0 {
+		d := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := c.walked[d.Hash]; ok || len(d.Hash) <= 2 {
+			continue
+		}
+		c.walked[d.Hash] = struct{}{}
+
+		data, err := c.read(ctx, cache.CAS, hashKey(d.Hash))
+		if errors.Is(err, cache.ErrNotFound) {
+			log.Debug().Str("directory", d.Hash).Msg("gc missing directory")
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		dir, err := reapi.DecodeDirectory(data)
+		if err != nil {
+			log.Warn().Err(err).Str("directory", d.Hash).Msg("gc undecodable directory")
+			return err
+		}
+		c.mark(dir.Files)
+		c.mark(dir.Directories)
+		pending = append(pending, dir.Directories...)
+	}
+	return nil
+}
+
+// Collect marks every CAS blob referenced by an AC entry and then sweeps the
+// CAS for blobs that weren't marked and are older than the grace period. AC
+// entries written while the sweep runs are marked again before anything is
+// deleted, so results stored mid-collection keep their outputs. If any AC
+// entry can't be decoded, the blobs it refers to can't be told apart from
+// garbage, so nothing is deleted and the report only says what would be.
+func Collect(ctx context.Context, c cache.Cache, opts Options) (Report, error) {
+	start := time.Now()
+	col := &collector{cache: c, marked: make(map[string]struct{}), walked: make(map[string]struct{}), log: *zerolog.Ctx(ctx)}
+	report := Report{}
+
+	markAll := func(since time.Time, report *Report) error {
+		return cache.Walk(ctx, c, cache.AC, func(key cache.Key, info cache.Info) error {
+			if info.ModTime.Before(since) {
+				return nil
+			}
+			report.ACEntries++
+			err := col.markAction(ctx, key)
+			if errors.Is(err, reapi.ErrMalformed) {
+				report.Undecodable++
+				return nil
+			}
+			return err
+		})
+	}
+	if err := markAll(time.Time{}, &report); err != nil {
+		return report, err
+	}
+
+	cutoff := start.Add(-opts.Grace)
+	var candidates []cache.Key
+	var sizes []int64
+	if err := cache.Walk(ctx, c, cache.CAS, func(key cache.Key, info cache.Info) error {
+		report.CASEntries++
+		report.CASBytes += info.Size
+		if _, ok := col.marked[path.Base(string(key))]; ok {
+			return nil
+		}
+		report.Unreferenced++
+		report.UnreferencedBytes += info.Size
+		if info.ModTime.Before(cutoff) {
+			candidates = append(candidates, key)
+			sizes = append(sizes, info.Size)
+		}
+		return nil
+	}); err != nil {
+		return report, err
+	}
+
+	late := Report{}
+	if err := markAll(start, &late); err != nil {
+		return report, err
+	}
+	report.Undecodable += late.Undecodable
+	report.Referenced = len(col.marked)
+
+	dryRun := opts.DryRun
+	if report.Undecodable > 0 && !dryRun {
+		col.log.Warn().Int("undecodable", report.Undecodable).Msg("gc found undecodable action results, not deleting")
+		dryRun = true
+	}
+	report.DryRun = dryRun
+
+	front := c
+	if opts.Front != nil {
+		front = opts.Front
+	}
+	for i, key := range candidates {
+		if _, ok := col.marked[path.Base(string(key))]; ok {
+			continue
+		}
+		// a dry run is only useful for what it would delete
+		level := zerolog.DebugLevel
+		if dryRun {
+			level = zerolog.InfoLevel
+		}
+		col.log.WithLevel(level).Stringer("key", key).Int64("size", sizes[i]).Bool("dry run", dryRun).Msg("gc unreferenced")
+		if !dryRun {
+			if err := cache.Delete(ctx, front, cache.CAS, key); err != nil && !errors.Is(err, cache.ErrNotFound) {
+				return report, err
+			}
+		}
+		report.Deleted++
+		report.DeletedBytes += sizes[i]
+	}
+	return report, nil
+}
+
+// Run collects garbage every interval until ctx is done.
+func Run(ctx context.Context, c cache.Cache, interval time.Duration, opts Options) {
+	log := zerolog.Ctx(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		report, err := Collect(ctx, c, opts)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				log.Err(err).Msg("gc")
+			}
+			continue
+		}
+		log.Info().
+			Int("ac entries", report.ACEntries).
+			Int("cas entries", report.CASEntries).
+			Int("referenced", report.Referenced).
+			Int("deleted", report.Deleted).
+			Int64("deleted bytes", report.DeletedBytes).
+			Dur("duration", time.Since(start)).
+			Msg("gc")
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gc
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func hash(c byte) string {
+	return strings.Repeat(string(c), 64)
+}
+
+func digest(hash string) []byte {
+	return message(nil, 1, []byte(hash))
+}
+
+func message(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func put(t *testing.T, c cache.Cache, store cache.Store, hash string, data []byte) {
+	w, err := c.Writer(context.Background(), store, hashKey(hash))
+	assert.NoError(t, err)
+	w.Write(data)
+	w.(io.Closer).Close()
+}
+
+func TestCollect(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	c := cache.NewMemCache()
+
+	// an output file, an output directory whose tree holds another file, an
+	// output directory with only its root Directory, and an orphan
+	tree := message(nil, 1, message(nil, 1, message(nil, 2, digest(hash('c')))))
+	ar := message(nil, 2, message(nil, 2, digest(hash('a'))))
+	ar = message(ar, 3, message(nil, 3, digest(hash('b'))))
+	put(t, c, cache.AC, hash('1'), ar)
+	put(t, c, cache.AC, hash('2'), []byte{0xff, 0xff})
+	put(t, c, cache.AC, hash('3'), message(nil, 3, message(nil, 5, digest(hash('e')))))
+	put(t, c, cache.CAS, hash('a'), []byte("a"))
+	put(t, c, cache.CAS, hash('b'), tree)
+	put(t, c, cache.CAS, hash('c'), []byte("c"))
+	put(t, c, cache.CAS, hash('d'), []byte("orphan"))
+	root := message(nil, 1, message(nil, 2, digest(hash('f'))))
+	root = message(root, 2, message(nil, 2, digest(hash('g'))))
+	put(t, c, cache.CAS, hash('e'), root)
+	put(t, c, cache.CAS, hash('f'), []byte("f"))
+	put(t, c, cache.CAS, hash('g'), message(nil, 1, message(nil, 2, digest(hash('h')))))
+	put(t, c, cache.CAS, hash('h'), []byte("h"))
+
+	// everything is within the grace period
+	report, err := Collect(ctx, c, Options{Grace: time.Hour})
+	assert.NoError(err)
+	assert.Equal(8, report.CASEntries)
+	assert.Equal(1, report.Unreferenced)
+	assert.Equal(0, report.Deleted)
+
+	report, err = Collect(ctx, c, Options{DryRun: true})
+	assert.NoError(err)
+	assert.Equal(3, report.ACEntries)
+	assert.Equal(1, report.Undecodable)
+	assert.Equal(7, report.Referenced)
+	assert.Equal(1, report.Deleted)
+	assert.Equal(int64(6), report.DeletedBytes)
+	assert.True(report.DryRun)
+	assert.NoError(c.Exists(ctx, cache.CAS, hashKey(hash('d'))))
+
+	// the undecodable entry may refer to anything, so nothing is deleted
+	report, err = Collect(ctx, c, Options{})
+	assert.NoError(err)
+	assert.Equal(1, report.Deleted)
+	assert.True(report.DryRun)
+	assert.NoError(c.Exists(ctx, cache.CAS, hashKey(hash('d'))))
+	assert.NoError(cache.Delete(ctx, c, cache.AC, hashKey(hash('2'))))
+
+	// an LRU in front is neither filled nor left holding what's deleted
+	lru := cache.NewLRUCache(c, 1024)
+	lru.Reader(ctx, cache.CAS, hashKey(hash('d')))
+	report, err = Collect(ctx, c, Options{Front: lru})
+	assert.NoError(err)
+	assert.Equal(1, report.Deleted)
+	assert.False(report.DryRun)
+	assert.Equal(int64(0), lru.Size())
+	assert.ErrorIs(c.Exists(ctx, cache.CAS, hashKey(hash('d'))), cache.ErrNotFound)
+	for _, h := range []byte("abcefgh") {
+		assert.NoError(c.Exists(ctx, cache.CAS, hashKey(hash(h))))
+	}
+}
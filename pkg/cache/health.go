@@ -0,0 +1,123 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	health "github.com/etherlabsio/healthcheck/v2"
+)
+
+// ErrDraining is reported by a Drain once it has started.
+var ErrDraining = errors.New("draining")
+
+// checkTimeout bounds each check made by a healthHandler.
+const checkTimeout = 5 * time.Second
+
+// Drain fails readiness once started so that traffic moves elsewhere ahead of
+// a shutdown.
+type Drain struct {
+	draining int32
+}
+
+var _ health.Checker = &Drain{}
+
+func (d *Drain) Start() {
+	atomic.StoreInt32(&d.draining, 1)
+}
+
+func (d *Drain) Check(context.Context) error {
+	if atomic.LoadInt32(&d.draining) != 0 {
+		return ErrDraining
+	}
+	return nil
+}
+
+type checkResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// healthHandler runs its checks concurrently and reports each of them,
+// failing with 503 if any of them fail. With no checks it only shows that the
+// process is serving requests.
+type healthHandler struct {
+	checks map[string]health.Checker
+}
+
+var _ http.Handler = &healthHandler{}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	resp := healthResponse{Status: "ok", Checks: make(map[string]checkResult, len(h.checks))}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, checker := range h.checks {
+		wg.Add(1)
+		go func(name string, checker health.Checker) {
+			defer wg.Done()
+			start := time.Now()
+			err := runCheck(ctx, checker)
+			result := checkResult{Status: "ok", Duration: time.Since(start).String()}
+			if err != nil {
+				result.Status = "failing"
+				result.Error = err.Error()
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			resp.Checks[name] = result
+			if err != nil {
+				resp.Status = "failing"
+			}
+		}(name, checker)
+	}
+	wg.Wait()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, resp)
+}
+
+// runCheck gives up on checks that don't return once ctx is done.
+func runCheck(ctx context.Context, checker health.Checker) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- checker.Check(ctx)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	health "github.com/etherlabsio/healthcheck/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	assert := assert.New(t)
+	drain := &Drain{}
+	var backendErr error
+	backend := health.CheckerFunc(func(context.Context) error { return backendErr })
+	s := NewServer(":0", NewMemCache(), WithReadyCheck("backend", backend), WithReadyCheck("drain", drain))
+
+	check := func(path string) (int, healthResponse) {
+		w := httptest.NewRecorder()
+		s.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp healthResponse
+		json.NewDecoder(w.Result().Body).Decode(&resp)
+		return w.Result().StatusCode, resp
+	}
+
+	code, resp := check("/readyz")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("ok", resp.Status)
+	assert.Equal("ok", resp.Checks["backend"].Status)
+	assert.Equal("ok", resp.Checks["drain"].Status)
+
+	backendErr = errors.New("s3 is down")
+	code, resp = check("/readyz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("failing", resp.Status)
+	assert.Equal(checkResult{Status: "failing", Error: "s3 is down", Duration: resp.Checks["backend"].Duration}, resp.Checks["backend"])
+	assert.Equal("ok", resp.Checks["drain"].Status)
+
+	// liveness doesn't depend on the backend
+	code, resp = check("/livez")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("ok", resp.Status)
+	assert.Empty(resp.Checks)
+
+	backendErr = nil
+	drain.Start()
+	code, resp = check("/readyz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(ErrDraining.Error(), resp.Checks["drain"].Error)
+}
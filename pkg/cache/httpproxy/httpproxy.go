@@ -0,0 +1,324 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package httpproxy is a cache backed by an upstream HTTP cache, such as
+// another buzzel, bazel-remote or nginx with WebDAV.
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	health "github.com/etherlabsio/healthcheck/v2"
+	"github.com/rs/zerolog"
+)
+
+// Options configures a Cache.
+type Options struct {
+	// Header is added to every request, such as an Authorization header.
+	// Basic auth can also be given in the upstream URL.
+	Header http.Header
+	// Timeout bounds how long the upstream has to respond to a request,
+	// without limiting how long the entry takes to transfer.
+	Timeout time.Duration
+	// Retries is how many times reads are retried after the upstream fails
+	// to respond or responds with a server error, waiting Backoff and then
+	// twice as long again between each attempt. Uploads aren't retried since
+	// they're streamed.
+	Retries int
+	Backoff time.Duration
+}
+
+// Cache issues HEAD, GET and PUT requests for entries to an upstream at
+// <url>/ac/<hash> and <url>/cas/<hash>.
+type Cache struct {
+	base   *url.URL
+	opts   Options
+	client *http.Client
+}
+
+var _ cache.Cache = &Cache{}
+
+// New returns a cache for the upstream at rawurl.
+func New(rawurl string, opts Options) (*Cache, error) {
+	base, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("upstream must be an http or https url: %s", rawurl)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost:   64,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: opts.Timeout,
+		},
+	}
+	return &Cache{base: base, opts: opts, client: client}, nil
+}
+
+func (c *Cache) url(store cache.Store, key cache.Key) string {
+	u := *c.base
+	u.Path += "/" + string(store) + "/" + path.Base(string(key))
+	return u.String()
+}
+
+func (c *Cache) request(ctx context.Context, method string, store cache.Store, key cache.Key, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(store, key), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.opts.Header {
+		req.Header[name] = values
+	}
+	// ask for the entry as it's stored so that sizes are exact
+	req.Header.Set("Accept-Encoding", "identity")
+	return req, nil
+}
+
+// retryable reports whether a request that failed with err or resp is worth
+// trying again.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// do sends req, retrying it if it has no body, and returns its response if
+// its status is one of ok.
+func (c *Cache) do(req *http.Request, ok ...int) (*http.Response, error) {
+	retries := c.opts.Retries
+	if req.Body != nil {
+		retries = 0
+	}
+
+	var resp *http.Response
+	var err error
+	backoff := c.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err = c.client.Do(req)
+		if attempt >= retries || !retryable(resp, err) {
+			break
+		}
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		zerolog.Ctx(req.Context()).Debug().
+			Err(err).
+			Str("method", req.Method).
+			Stringer("url", req.URL).
+			Int("attempt", attempt+1).
+			Msg("upstream retry")
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, cache.ErrNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, cache.ErrInvalidRange
+	}
+	return nil, fmt.Errorf("upstream %s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+}
+
+func (c *Cache) Exists(ctx context.Context, store cache.Store, key cache.Key) error {
+	_, err := c.Stat(ctx, store, key)
+	return err
+}
+
+func (c *Cache) Stat(ctx context.Context, store cache.Store, key cache.Key) (cache.Info, error) {
+	req, err := c.request(ctx, http.MethodHead, store, key, nil)
+	if err != nil {
+		return cache.Info{}, err
+	}
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return cache.Info{}, err
+	}
+	resp.Body.Close()
+
+	info := cache.Info{Size: resp.ContentLength}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info, nil
+}
+
+func (c *Cache) Reader(ctx context.Context, store cache.Store, key cache.Key) (io.Reader, int64, error) {
+	req, err := c.request(ctx, http.MethodGet, store, key, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, -1, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+var _ cache.RangeReader = &Cache{}
+
+// RangeReader asks the upstream for just the range, falling back to skipping
+// through the whole entry for upstreams that don't support ranges.
+func (c *Cache) RangeReader(ctx context.Context, store cache.Store, key cache.Key, offset, length int64) (io.Reader, int64, error) {
+	req, err := c.request(ctx, http.MethodGet, store, key, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	switch {
+	case offset < 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d", offset))
+	case length < 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	default:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+
+	resp, err := c.do(req, http.StatusPartialContent, http.StatusOK)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		// Content-Range looks like "bytes 0-99/200"
+		size := int64(-1)
+		if cr := resp.Header.Get("Content-Range"); cr != "" {
+			if i := strings.LastIndexByte(cr, '/'); i >= 0 {
+				size, _ = strconv.ParseInt(cr[i+1:], 10, 64)
+			}
+		}
+		return resp.Body, size, nil
+	}
+
+	size := resp.ContentLength
+	if offset < 0 {
+		offset, length = size+offset, -1
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	if size >= 0 && offset >= size {
+		resp.Body.Close()
+		return nil, -1, cache.ErrInvalidRange
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+		resp.Body.Close()
+		return nil, -1, err
+	}
+	if length < 0 {
+		return resp.Body, size, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, length), resp.Body}, size, nil
+}
+
+// Writer streams the entry upstream as it's written. Close waits for the
+// upstream to store it.
+func (c *Cache) Writer(ctx context.Context, store cache.Store, key cache.Key) (io.Writer, error) {
+	pr, pw := io.Pipe()
+	req, err := c.request(ctx, http.MethodPut, store, key, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &writer{PipeWriter: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := c.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+		if err == nil {
+			resp.Body.Close()
+		}
+		// unblock writes if the upstream gave up early
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+var errAborted = errors.New("httpproxy: upload aborted")
+
+type writer struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *writer) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+var _ cache.Aborter = &writer{}
+
+func (w *writer) Abort() error {
+	w.CloseWithError(errAborted)
+	<-w.done
+	return nil
+}
+
+var _ health.Checker = &Cache{}
+
+// Check reports whether the upstream is reachable at all; any response short
+// of a server error will do.
+func (c *Cache) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.base.String()+"/", nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.opts.Header {
+		req.Header[name] = values
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("upstream %s: %s", c.base.Redacted(), resp.Status)
+	}
+	return nil
+}
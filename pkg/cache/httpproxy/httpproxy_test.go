@@ -0,0 +1,110 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+const digest = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+var key = cache.Key(digest[:2] + "/" + digest)
+
+func TestCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	upstream := cache.NewServer("", cache.NewMemCache()).Handler
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Fail") != "" && failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		upstream.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c, err := New(server.URL+"/", Options{
+		Header:  http.Header{"Authorization": {"Bearer secret"}},
+		Timeout: time.Second,
+		Retries: 2,
+		Backoff: time.Millisecond,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.True(errors.Is(c.Exists(ctx, cache.CAS, key), cache.ErrNotFound))
+
+	w, err := c.Writer(ctx, cache.CAS, key)
+	if assert.NoError(err) {
+		w.Write([]byte("test"))
+		assert.NoError(w.(io.Closer).Close())
+	}
+
+	info, err := c.Stat(ctx, cache.CAS, key)
+	assert.NoError(err)
+	assert.Equal(int64(4), info.Size)
+	assert.False(info.ModTime.IsZero())
+
+	r, size, err := c.Reader(ctx, cache.CAS, key)
+	if assert.NoError(err) {
+		b, _ := ioutil.ReadAll(r)
+		r.(io.Closer).Close()
+		assert.Equal("test", string(b))
+		assert.Equal(int64(4), size)
+	}
+
+	r, size, err = c.RangeReader(ctx, cache.CAS, key, 1, 2)
+	if assert.NoError(err) {
+		b, _ := ioutil.ReadAll(r)
+		r.(io.Closer).Close()
+		assert.Equal("es", string(b))
+		assert.Equal(int64(4), size)
+	}
+	_, _, err = c.RangeReader(ctx, cache.CAS, key, 10, 2)
+	assert.True(errors.Is(err, cache.ErrInvalidRange))
+
+	// aborted uploads aren't stored
+	w, err = c.Writer(ctx, cache.AC, key)
+	if assert.NoError(err) {
+		w.Write([]byte("partial"))
+		assert.NoError(cache.Abort(w))
+	}
+	assert.True(errors.Is(c.Exists(ctx, cache.AC, key), cache.ErrNotFound))
+
+	// reads are retried through server errors
+	c.opts.Header.Set("X-Fail", "true")
+	assert.NoError(c.Exists(ctx, cache.CAS, key))
+	failures = 3
+	assert.Error(c.Exists(ctx, cache.CAS, key))
+}
@@ -0,0 +1,431 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"golang.org/x/time/rate"
+)
+
+// Limit restricts the requests of a single client. Zero values don't limit
+// anything.
+type Limit struct {
+	// Rate is how many requests per second are allowed, with bursts of up
+	// to Burst requests.
+	Rate  float64
+	Burst int
+	// Concurrency is how many requests can be in flight at once.
+	Concurrency int
+}
+
+// LimitRule applies a Limit to requests for a store and method. An empty
+// store or method matches any.
+type LimitRule struct {
+	Store  Store
+	Method string
+	Limit
+}
+
+// ParseLimitRule parses a rule written as "store:method:limits", such as
+// "cas:PUT:rate=50,burst=100,concurrency=8". The store and method can be "*"
+// to match any.
+func ParseLimitRule(s string) (LimitRule, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return LimitRule{}, fmt.Errorf("invalid limit rule %q: expected store:method:limits", s)
+	}
+
+	rule := LimitRule{}
+	if parts[0] != "*" {
+		store, ok := storeFromString(parts[0])
+		if !ok {
+			return LimitRule{}, fmt.Errorf("invalid limit rule %q: unknown store %s", s, parts[0])
+		}
+		rule.Store = store
+	}
+	if parts[1] != "*" {
+		rule.Method = strings.ToUpper(parts[1])
+	}
+
+	for _, field := range strings.Split(parts[2], ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return LimitRule{}, fmt.Errorf("invalid limit rule %q: expected name=value, got %q", s, field)
+		}
+		var err error
+		switch kv[0] {
+		case "rate":
+			rule.Rate, err = strconv.ParseFloat(kv[1], 64)
+		case "burst":
+			rule.Burst, err = strconv.Atoi(kv[1])
+		case "concurrency":
+			rule.Concurrency, err = strconv.Atoi(kv[1])
+		default:
+			err = fmt.Errorf("unknown limit %s", kv[0])
+		}
+		if err != nil {
+			return LimitRule{}, fmt.Errorf("invalid limit rule %q: %w", s, err)
+		}
+	}
+	return rule, nil
+}
+
+// Limits configures the limits applied by the server.
+type Limits struct {
+	// Default applies to requests that don't match any rule.
+	Default Limit
+	// Rules are matched most specific first: store and method, store, then
+	// method.
+	Rules []LimitRule
+	// Quota is how many bytes each client can upload per QuotaPeriod. It
+	// counts bytes sent rather than bytes stored, since entries aren't
+	// tracked back to whoever uploaded them. Uploads reserve their
+	// Content-Length up front, and fail once they've sent more than is left.
+	// Either way they're answered with 429 Too Many Requests and when the
+	// quota resets.
+	Quota       int64
+	QuotaPeriod time.Duration
+	// Identify returns the client a request is counted against. By default
+	// that's its remote IP.
+	Identify func(*http.Request) string
+	// Exempt, if set, lets through requests that aren't limited at all, such
+	// as those forwarded by peers.
+	Exempt func(*http.Request) bool
+}
+
+// IdentifyByIP identifies clients by their remote IP.
+func IdentifyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// IdentifyByHeader identifies clients by a header, such as one naming the
+// tenant or principal set by an authenticating proxy, and by their remote IP
+// when it's missing.
+func IdentifyByHeader(name string) func(*http.Request) string {
+	return func(r *http.Request) string {
+		if id := r.Header.Get(name); id != "" {
+			return id
+		}
+		return IdentifyByIP(r)
+	}
+}
+
+// limitIdle is how long a client's limiter is kept once it's no longer used.
+const limitIdle = 10 * time.Minute
+
+// limiter enforces Limits, keeping the state of each client and rule.
+type limiter struct {
+	limits  Limits
+	lock    sync.Mutex
+	clients map[clientRule]*clientState
+	quotas  map[string]*quotaState
+	swept   time.Time
+}
+
+type quotaState struct {
+	used  int64
+	reset time.Time
+}
+
+type clientRule struct {
+	client string
+	rule   int // index into limits.Rules, or -1 for the default
+}
+
+type clientState struct {
+	limiter  *rate.Limiter
+	inflight int
+	lastSeen time.Time
+}
+
+func newLimiter(limits Limits) *limiter {
+	if limits.Identify == nil {
+		limits.Identify = IdentifyByIP
+	}
+	if limits.QuotaPeriod <= 0 {
+		limits.QuotaPeriod = 24 * time.Hour
+	}
+	return &limiter{
+		limits:  limits,
+		clients: make(map[clientRule]*clientState),
+		quotas:  make(map[string]*quotaState),
+		swept:   time.Now(),
+	}
+}
+
+// match returns the index of the most specific rule for store and method, or
+// -1 if there isn't one.
+func (l *limiter) match(store Store, method string) int {
+	best, bestScore := -1, 0
+	for i, rule := range l.limits.Rules {
+		if (rule.Store != "" && rule.Store != store) || (rule.Method != "" && rule.Method != method) {
+			continue
+		}
+		score := 1
+		if rule.Store != "" {
+			score += 2
+		}
+		if rule.Method != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// acquire admits a request, returning a func to call when it's done. If it's
+// not admitted it returns how long the client should wait before retrying.
+func (l *limiter) acquire(client string, store Store, method string) (func(), time.Duration) {
+	i := l.match(store, method)
+	limit := l.limits.Default
+	if i >= 0 {
+		limit = l.limits.Rules[i].Limit
+	}
+	if limit.Rate <= 0 && limit.Concurrency <= 0 {
+		return func() {}, 0
+	}
+
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now)
+
+	key := clientRule{client, i}
+	state, ok := l.clients[key]
+	if !ok {
+		state = &clientState{}
+		if limit.Rate > 0 {
+			burst := limit.Burst
+			if burst < 1 {
+				burst = int(math.Ceil(limit.Rate))
+			}
+			state.limiter = rate.NewLimiter(rate.Limit(limit.Rate), burst)
+		}
+		l.clients[key] = state
+	}
+	state.lastSeen = now
+
+	if limit.Concurrency > 0 && state.inflight >= limit.Concurrency {
+		return nil, time.Second
+	}
+	if state.limiter != nil {
+		r := state.limiter.ReserveN(now, 1)
+		if delay := r.DelayFrom(now); !r.OK() || delay > 0 {
+			r.CancelAt(now)
+			if delay <= 0 {
+				delay = time.Second
+			}
+			return nil, delay
+		}
+	}
+
+	state.inflight++
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		state.inflight--
+		state.lastSeen = time.Now()
+	}, 0
+}
+
+// sweep forgets clients that have been idle for a while. It runs at most once
+// per limitIdle.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < limitIdle {
+		return
+	}
+	l.swept = now
+	for key, state := range l.clients {
+		if state.inflight == 0 && now.Sub(state.lastSeen) > limitIdle {
+			delete(l.clients, key)
+		}
+	}
+	for client, quota := range l.quotas {
+		if now.After(quota.reset) {
+			delete(l.quotas, client)
+		}
+	}
+}
+
+// quota returns the quota state of client for the current period.
+func (l *limiter) quota(client string, now time.Time) *quotaState {
+	quota, ok := l.quotas[client]
+	if !ok || now.After(quota.reset) {
+		quota = &quotaState{reset: now.Add(l.limits.QuotaPeriod)}
+		l.quotas[client] = quota
+	}
+	return quota
+}
+
+// errQuotaExceeded is returned when reading an upload once the client's
+// quota has run out, as a quotaError saying when it resets.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+type quotaError struct {
+	wait time.Duration
+}
+
+func (e *quotaError) Error() string {
+	return errQuotaExceeded.Error()
+}
+
+func (e *quotaError) Is(target error) bool {
+	return target == errQuotaExceeded
+}
+
+// reserve takes size bytes of client's quota up front for an upload, so that
+// concurrent uploads can't all fit in what's left of it. Uploads of unknown
+// size, if it's negative, reserve nothing and only need some quota left. If
+// it doesn't fit it returns how long until the quota resets.
+func (l *limiter) reserve(client string, size int64) (bool, time.Duration) {
+	if l.limits.Quota <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	quota := l.quota(client, now)
+	if size < 0 {
+		if quota.used >= l.limits.Quota {
+			return false, quota.reset.Sub(now)
+		}
+		return true, 0
+	}
+	if quota.used+size > l.limits.Quota {
+		return false, quota.reset.Sub(now)
+	}
+	quota.used += size
+	return true, 0
+}
+
+// charge counts n more uploaded bytes against client's quota, or refunds
+// them if n is negative. It returns false if that leaves the quota exceeded,
+// along with how long until it resets.
+func (l *limiter) charge(client string, n int64) (bool, time.Duration) {
+	if l.limits.Quota <= 0 || n == 0 {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	quota := l.quota(client, now)
+	quota.used += n
+	if quota.used > l.limits.Quota {
+		return false, quota.reset.Sub(now)
+	}
+	return true, 0
+}
+
+// quotaReader charges the bytes read through it beyond those reserved,
+// failing once the quota is exceeded.
+type quotaReader struct {
+	io.ReadCloser
+	limiter  *limiter
+	client   string
+	reserved int64
+	n        int64
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	charged := r.reserved
+	if r.n > charged {
+		charged = r.n
+	}
+	r.n += int64(n)
+	if r.n > charged {
+		if ok, wait := r.limiter.charge(r.client, r.n-charged); !ok {
+			return n, &quotaError{wait: wait}
+		}
+	}
+	return n, err
+}
+
+// done refunds whatever was reserved but never read.
+func (r *quotaReader) done() {
+	if r.n < r.reserved {
+		r.limiter.charge(r.client, r.n-r.reserved)
+	}
+}
+
+func tooMany(w http.ResponseWriter, r *http.Request, client string, wait time.Duration, msg string) {
+	retry := retryAfter(wait)
+	hlog.FromRequest(r).Debug().Caller().
+		Str("client", client).
+		Str("retry after", retry).
+		Msg(msg)
+	w.Header().Set("Retry-After", retry)
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// retryAfter formats wait as a Retry-After header, in whole seconds.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// middleware limits the requests for store, rejecting those over the limit
+// with 429 Too Many Requests.
+func (l *limiter) middleware(store Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l.limits.Exempt != nil && l.limits.Exempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			client := l.limits.Identify(r)
+			release, wait := l.acquire(client, store, r.Method)
+			if release == nil {
+				tooMany(w, r, client, wait, "rate limited")
+				return
+			}
+			defer release()
+
+			if r.Method != http.MethodPut {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if ok, wait := l.reserve(client, r.ContentLength); !ok {
+				tooMany(w, r, client, wait, "quota exceeded")
+				return
+			}
+			body := &quotaReader{ReadCloser: r.Body, limiter: l, client: client}
+			if r.ContentLength > 0 {
+				body.reserved = r.ContentLength
+			}
+			r.Body = body
+			defer body.done()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLimitRule(t *testing.T) {
+	assert := assert.New(t)
+	specs := []struct {
+		s    string
+		rule LimitRule
+		ok   bool
+	}{
+		{"cas:put:rate=50,burst=100,concurrency=8", LimitRule{CAS, http.MethodPut, Limit{50, 100, 8}}, true},
+		{"*:GET:rate=0.5", LimitRule{"", http.MethodGet, Limit{Rate: 0.5}}, true},
+		{"ac:*:concurrency=2", LimitRule{AC, "", Limit{Concurrency: 2}}, true},
+		{"cas:rate=1", LimitRule{}, false},
+		{"foo:*:rate=1", LimitRule{}, false},
+		{"cas:*:rate", LimitRule{}, false},
+		{"cas:*:speed=1", LimitRule{}, false},
+		{"cas:*:burst=lots", LimitRule{}, false},
+	}
+
+	for _, spec := range specs {
+		rule, err := ParseLimitRule(spec.s)
+		if spec.ok {
+			assert.NoError(err, spec.s)
+			assert.Equal(spec.rule, rule, spec.s)
+		} else {
+			assert.Error(err, spec.s)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+	l := newLimiter(Limits{
+		Default: Limit{Rate: 1, Burst: 2},
+		Rules: []LimitRule{
+			{Method: http.MethodHead},
+			{Store: CAS, Limit: Limit{Concurrency: 1}},
+			{Store: CAS, Method: http.MethodGet, Limit: Limit{Rate: 1, Burst: 1}},
+		},
+		Identify: IdentifyByHeader("X-Tenant"),
+		Exempt: func(r *http.Request) bool {
+			return r.Header.Get("X-Exempt") != ""
+		},
+	})
+
+	release := make(chan struct{})
+	h := func(store Store) http.Handler {
+		return l.middleware(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Block") != "" {
+				<-release
+			}
+		}))
+	}
+	do := func(store Store, method, tenant string) *http.Response {
+		req := httptest.NewRequest(method, "/"+string(store)+"/"+digests[0], nil)
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		h(store).ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// default rate with a burst of two
+	assert.Equal(http.StatusOK, do(AC, http.MethodGet, "a").StatusCode)
+	assert.Equal(http.StatusOK, do(AC, http.MethodPut, "a").StatusCode)
+	resp := do(AC, http.MethodGet, "a")
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal("1", resp.Header.Get("Retry-After"))
+	// other clients have their own limits
+	assert.Equal(http.StatusOK, do(AC, http.MethodGet, "b").StatusCode)
+	// exempt requests aren't limited at all
+	req := httptest.NewRequest(http.MethodGet, "/ac/"+digests[0], nil)
+	req.Header.Set("X-Tenant", "a")
+	req.Header.Set("X-Exempt", "true")
+	w := httptest.NewRecorder()
+	h(AC).ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+	// HEAD is unlimited
+	for i := 0; i < 5; i++ {
+		assert.Equal(http.StatusOK, do(AC, http.MethodHead, "a").StatusCode)
+	}
+
+	// the most specific rule wins
+	assert.Equal(http.StatusOK, do(CAS, http.MethodGet, "a").StatusCode)
+	assert.Equal(http.StatusTooManyRequests, do(CAS, http.MethodGet, "a").StatusCode)
+
+	// one request at a time for the rest of CAS
+	done := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest(http.MethodPut, "/cas/"+digests[0], nil)
+		req.Header.Set("X-Tenant", "a")
+		req.Header.Set("X-Block", "true")
+		h(CAS).ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	assert.Eventually(func() bool {
+		return do(CAS, http.MethodPut, "a").StatusCode == http.StatusTooManyRequests
+	}, time.Second, time.Millisecond)
+	assert.Equal(http.StatusOK, do(CAS, http.MethodPut, "b").StatusCode)
+	close(release)
+	<-done
+	assert.Equal(http.StatusOK, do(CAS, http.MethodPut, "a").StatusCode)
+}
+
+func TestLimiterQuota(t *testing.T) {
+	assert := assert.New(t)
+	l := newLimiter(Limits{Quota: 10, QuotaPeriod: time.Hour})
+	h := l.middleware(CAS)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			handleHttpError(w, r, err)
+		}
+	}))
+	put := func(body string, chunked bool) *http.Response {
+		req := httptest.NewRequest(http.MethodPut, "/cas/"+digests[0], strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		if chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	assert.Equal(http.StatusOK, put("0123", false).StatusCode)
+	assert.Equal(http.StatusOK, put("0123", true).StatusCode)
+	resp := put("0123", false)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal("3600", resp.Header.Get("Retry-After"))
+	assert.Equal(http.StatusOK, put("01", false).StatusCode)
+	assert.Equal(http.StatusTooManyRequests, put("", true).StatusCode)
+
+	// chunked uploads fail once they've sent more than is left
+	l.quotas["192.0.2.1"].used = 6
+	resp = put("012345", true)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal("3600", resp.Header.Get("Retry-After"))
+
+	// uploads reserve their size, so concurrent ones can't both fit
+	ok, _ := l.reserve("b", 6)
+	assert.True(ok)
+	ok, _ = l.reserve("b", 6)
+	assert.False(ok)
+	// and what they don't send is refunded
+	body := &quotaReader{ReadCloser: io.NopCloser(strings.NewReader("01")), limiter: l, client: "b", reserved: 6}
+	io.Copy(io.Discard, body)
+	body.done()
+	assert.Equal(int64(2), l.quotas["b"].used)
+
+	// reads aren't counted
+	req := httptest.NewRequest(http.MethodGet, "/cas/"+digests[0], nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Result().StatusCode)
+}
@@ -22,6 +22,7 @@ import (
 	"io"
 	"path"
 	"sync"
+	"time"
 
 	health "github.com/etherlabsio/healthcheck/v2"
 	"github.com/rs/zerolog"
@@ -34,12 +35,15 @@ type LRU struct {
 	mp    map[string]*list.Element
 	size  int64
 	max   int64
+	// warming is set while Warm is running
+	warming int32
 }
 
 type entry struct {
-	store Store
-	key   Key
-	data  []byte
+	store   Store
+	key     Key
+	data    []byte
+	modTime time.Time
 }
 
 var _ Cache = &LRU{}
@@ -48,14 +52,46 @@ func NewLRUCache(cache Cache, max int64) *LRU {
 	return &LRU{cache: cache, ll: list.New(), mp: make(map[string]*list.Element), max: max}
 }
 
+// Size is how many bytes of entries are held in memory.
+func (c *LRU) Size() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
+
+func (c *LRU) Max() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.max
+}
+
+// SetMax changes how many bytes of entries can be held in memory, evicting
+// entries until they fit.
+func (c *LRU) SetMax(max int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.max = max
+	for c.size > c.max {
+		c.pop()
+	}
+}
+
 func resolve(store Store, key Key) string {
 	return path.Join(string(store), string(key))
 }
 
 func (c *LRU) touch(store Store, key Key) ([]byte, bool) {
+	if en, ok := c.touchEntry(store, key); ok {
+		return en.data, true
+	}
+	return nil, false
+}
+
+func (c *LRU) touchEntry(store Store, key Key) (*entry, bool) {
 	if el, ok := c.mp[resolve(store, key)]; ok {
 		c.ll.MoveToFront(el)
-		return el.Value.(*entry).data, true
+		return el.Value.(*entry), true
 	}
 	return nil, false
 }
@@ -77,7 +113,7 @@ func (c *LRU) pop() (Store, Key, []byte) {
 }
 
 func (c *LRU) push(store Store, key Key, data []byte) {
-	c.mp[resolve(store, key)] = c.ll.PushFront(&entry{store, key, data})
+	c.mp[resolve(store, key)] = c.ll.PushFront(&entry{store: store, key: key, data: data})
 	c.size += int64(len(data))
 }
 
@@ -124,6 +160,19 @@ func (c *LRU) load(ctx context.Context, store Store, key Key) (io.Reader, int64,
 	return bytes.NewBuffer(data), size, nil
 }
 
+type peekKey struct{}
+
+// peek marks ctx as only asking whether entries exist, which the LRU answers
+// without loading them into memory.
+func peek(ctx context.Context) context.Context {
+	return context.WithValue(ctx, peekKey{}, true)
+}
+
+func peeking(ctx context.Context) bool {
+	peeking, _ := ctx.Value(peekKey{}).(bool)
+	return peeking
+}
+
 func (c *LRU) Exists(ctx context.Context, store Store, key Key) error {
 	log := zerolog.Ctx(ctx).With().
 		Stringer("store", store).
@@ -137,7 +186,7 @@ func (c *LRU) Exists(ctx context.Context, store Store, key Key) error {
 		return nil
 	}
 
-	if err := c.cache.Exists(ctx, store, key); err != nil {
+	if err := c.cache.Exists(ctx, store, key); err != nil || peeking(ctx) {
 		return err
 	}
 
@@ -145,6 +194,47 @@ func (c *LRU) Exists(ctx context.Context, store Store, key Key) error {
 	return err
 }
 
+// Stat answers from memory when it can. Entries loaded by Reader don't know
+// their modification time, so the first Stat of one asks the underlying cache.
+// Like Exists, it loads entries that aren't in memory yet unless ctx is only
+// peeking.
+func (c *LRU) Stat(ctx context.Context, store Store, key Key) (Info, error) {
+	log := zerolog.Ctx(ctx).With().
+		Stringer("store", store).
+		Stringer("key", key).
+		Logger()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if en, ok := c.touchEntry(store, key); ok {
+		log.Debug().Caller().Msg("cache hit")
+		if en.modTime.IsZero() {
+			info, err := c.cache.Stat(ctx, store, key)
+			if err != nil {
+				return Info{}, err
+			}
+			en.modTime = info.ModTime
+		}
+		return Info{Size: int64(len(en.data)), ModTime: en.modTime}, nil
+	}
+
+	info, err := c.cache.Stat(ctx, store, key)
+	if err != nil {
+		return Info{}, err
+	}
+
+	if info.Size > c.max || peeking(ctx) {
+		return info, nil
+	}
+	if _, _, err := c.load(ctx, store, key); err != nil {
+		return Info{}, err
+	}
+	if en, ok := c.touchEntry(store, key); ok {
+		en.modTime = info.ModTime
+	}
+	return info, nil
+}
+
 func (c *LRU) Reader(ctx context.Context, store Store, key Key) (io.Reader, int64, error) {
 	log := zerolog.Ctx(ctx).With().
 		Stringer("store", store).
@@ -161,6 +251,28 @@ func (c *LRU) Reader(ctx context.Context, store Store, key Key) (io.Reader, int6
 	return c.load(ctx, store, key)
 }
 
+var _ RangeReader = &LRU{}
+
+// RangeReader serves ranges of entries already in memory. Misses are read
+// straight from the underlying cache without being loaded, since ranged reads
+// are mostly used to resume downloads of blobs too large to keep around.
+func (c *LRU) RangeReader(ctx context.Context, store Store, key Key, offset, length int64) (io.Reader, int64, error) {
+	log := zerolog.Ctx(ctx).With().
+		Stringer("store", store).
+		Stringer("key", key).
+		Logger()
+	c.lock.Lock()
+	if data, ok := c.touch(store, key); ok {
+		c.lock.Unlock()
+		log.Debug().Caller().Msg("cache hit")
+		return SliceRange(data, offset, length)
+	}
+	c.lock.Unlock()
+
+	log.Debug().Caller().Msg("cache miss")
+	return ReadRange(ctx, c.cache, store, key, offset, length)
+}
+
 func (c *LRU) Writer(ctx context.Context, store Store, key Key) (io.Writer, error) {
 	c.lock.Lock()
 	c.evict(store, key)
@@ -168,6 +280,34 @@ func (c *LRU) Writer(ctx context.Context, store Store, key Key) (io.Writer, erro
 	return c.cache.Writer(ctx, store, key)
 }
 
+var _ Deleter = &LRU{}
+
+func (c *LRU) Delete(ctx context.Context, store Store, key Key) error {
+	c.lock.Lock()
+	c.evict(store, key)
+	c.lock.Unlock()
+	return Delete(ctx, c.cache, store, key)
+}
+
+var _ Walker = &LRU{}
+
+// Walk walks the underlying cache, which holds everything in memory and more.
+func (c *LRU) Walk(ctx context.Context, store Store, fn WalkFunc) error {
+	return Walk(ctx, c.cache, store, fn)
+}
+
+var _ SeekWalker = &LRU{}
+
+func (c *LRU) WalkAfter(ctx context.Context, store Store, after Key, fn WalkFunc) error {
+	return WalkAfter(ctx, c.cache, store, after, fn)
+}
+
+var _ Flusher = &LRU{}
+
+func (c *LRU) Flush(ctx context.Context) error {
+	return Flush(ctx, c.cache)
+}
+
 var _ health.Checker = &LRU{}
 
 func (c *LRU) Check(ctx context.Context) error {
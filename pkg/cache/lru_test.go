@@ -16,7 +16,11 @@ limitations under the License.
 package cache
 
 import (
+	"context"
+	"io"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -42,3 +46,96 @@ func TestLRUPushPop(t *testing.T) {
 	_, exists = lru.touch(store, "a")
 	assert.False(exists)
 }
+
+func TestLRUStat(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mem := NewMemCache()
+	lru := NewLRUCache(mem, 1024)
+
+	_, err := lru.Stat(ctx, CAS, "a")
+	assert.ErrorIs(err, ErrNotFound)
+
+	w, _ := mem.Writer(ctx, CAS, "a")
+	w.Write([]byte("foo"))
+	w.(io.Closer).Close()
+	expected, _ := mem.Stat(ctx, CAS, "a")
+
+	// peeking doesn't load
+	info, err := lru.Stat(peek(ctx), CAS, "a")
+	assert.NoError(err)
+	assert.Equal(expected, info)
+	assert.NoError(lru.Exists(peek(ctx), CAS, "a"))
+	assert.Equal(int64(0), lru.Size())
+
+	// loaded by Reader, so the modification time comes from mem
+	lru.Reader(ctx, CAS, "a")
+	info, err = lru.Stat(ctx, CAS, "a")
+	assert.NoError(err)
+	assert.Equal(expected, info)
+
+	mem.mp[resolve(CAS, "a")].modTime = time.Time{}
+	info, err = lru.Stat(ctx, CAS, "a")
+	assert.NoError(err)
+	assert.Equal(expected, info)
+}
+
+func TestLRUWarm(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mem := NewMemCache()
+	fill(mem, CAS)
+	keys := make([]Key, len(digests))
+	for i, digest := range digests {
+		keys[i], _ = keyFromDigest(digest)
+	}
+
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+
+	// nothing to warm from yet
+	lru := NewLRUCache(mem, 1024)
+	loaded, err := lru.Warm(ctx, snapshot)
+	assert.NoError(err)
+	assert.Equal(0, loaded)
+
+	for _, key := range keys {
+		lru.Reader(ctx, CAS, key)
+	}
+	w, _ := mem.Writer(ctx, AC, keys[0])
+	w.Write(make([]byte, 200))
+	w.(io.Closer).Close()
+	lru.Reader(ctx, AC, keys[0])
+	assert.NoError(lru.SaveSnapshot(snapshot))
+
+	// the hottest doesn't fit at all, and there's only room for the next two
+	lru = NewLRUCache(mem, 128)
+	loaded, err = lru.Warm(ctx, snapshot)
+	assert.NoError(err)
+	assert.Equal(2, loaded)
+	assert.NoError(lru.CheckWarm(ctx))
+	assert.Equal(int64(128), lru.Size())
+	assert.Equal("cas/"+string(keys[2])+"\ncas/"+string(keys[1])+"\n", string(lru.Snapshot()))
+
+	lru.SetWarming()
+	assert.ErrorIs(lru.CheckWarm(ctx), ErrWarming)
+}
+
+func TestLRUSetMax(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mem := NewMemCache()
+	fill(mem, CAS)
+	lru := NewLRUCache(mem, 1024)
+	for _, digest := range digests {
+		key, _ := keyFromDigest(digest)
+		lru.Reader(ctx, CAS, key)
+	}
+	assert.Equal(int64(192), lru.Size())
+
+	lru.SetMax(100)
+	assert.Equal(int64(100), lru.Max())
+	assert.Equal(int64(64), lru.Size())
+	key, _ := keyFromDigest(digests[2])
+	_, ok := lru.touch(CAS, key)
+	assert.True(ok)
+}
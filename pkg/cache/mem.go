@@ -19,18 +19,26 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type MemCache struct {
-	mp   map[string][]byte
+	mp   map[string]*memdata
 	lock sync.RWMutex
 }
 
+type memdata struct {
+	data    []byte
+	modTime time.Time
+}
+
 var _ Cache = &MemCache{}
 
 func NewMemCache() *MemCache {
-	return &MemCache{mp: make(map[string][]byte)}
+	return &MemCache{mp: make(map[string]*memdata)}
 }
 
 func (c *MemCache) Exists(_ context.Context, store Store, key Key) error {
@@ -43,21 +51,100 @@ func (c *MemCache) Exists(_ context.Context, store Store, key Key) error {
 	return ErrNotFound
 }
 
+func (c *MemCache) Stat(_ context.Context, store Store, key Key) (Info, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if md, ok := c.mp[resolve(store, key)]; ok {
+		return Info{Size: int64(len(md.data)), ModTime: md.modTime}, nil
+	}
+	return Info{}, ErrNotFound
+}
+
 func (c *MemCache) Reader(_ context.Context, store Store, key Key) (io.Reader, int64, error) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	if data, ok := c.mp[resolve(store, key)]; ok {
-		return bytes.NewBuffer(data), int64(len(data)), nil
+	if md, ok := c.mp[resolve(store, key)]; ok {
+		return bytes.NewBuffer(md.data), int64(len(md.data)), nil
 	}
 	return nil, -1, ErrNotFound
 }
 
+var _ RangeReader = &MemCache{}
+
+func (c *MemCache) RangeReader(_ context.Context, store Store, key Key, offset, length int64) (io.Reader, int64, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if md, ok := c.mp[resolve(store, key)]; ok {
+		return SliceRange(md.data, offset, length)
+	}
+	return nil, -1, ErrNotFound
+}
+
+// SliceRange reads part of an entry held in memory, as RangeReader would.
+func SliceRange(data []byte, offset, length int64) (io.Reader, int64, error) {
+	size := int64(len(data))
+	start, n, err := ResolveRange(offset, length, size)
+	if err != nil {
+		return nil, size, err
+	}
+	return bytes.NewReader(data[start : start+n]), size, nil
+}
+
+var _ Deleter = &MemCache{}
+
+func (c *MemCache) Delete(_ context.Context, store Store, key Key) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	path := resolve(store, key)
+	if _, ok := c.mp[path]; !ok {
+		return ErrNotFound
+	}
+	delete(c.mp, path)
+	return nil
+}
+
+var _ Walker = &MemCache{}
+
+func (c *MemCache) Walk(ctx context.Context, store Store, fn WalkFunc) error {
+	type item struct {
+		key  Key
+		info Info
+	}
+
+	// snapshot the store so fn is free to modify the cache
+	c.lock.RLock()
+	prefix := string(store) + "/"
+	var items []item
+	for path, md := range c.mp {
+		if strings.HasPrefix(path, prefix) {
+			key := Key(strings.TrimPrefix(path, prefix))
+			items = append(items, item{key, Info{Size: int64(len(md.data)), ModTime: md.modTime}})
+		}
+	}
+	c.lock.RUnlock()
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+
+	for _, it := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(it.key, it.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type memwriter struct {
-	buf   *bytes.Buffer
-	cache *MemCache
-	store Store
-	key   Key
+	buf      *bytes.Buffer
+	cache    *MemCache
+	store    Store
+	key      Key
+	replaced int64
 }
 
 func (w *memwriter) Write(p []byte) (int, error) {
@@ -69,10 +156,27 @@ func (w *memwriter) Close() error {
 	defer w.cache.lock.Unlock()
 
 	data := w.buf.Bytes()
-	w.cache.mp[resolve(w.store, w.key)] = data
+	name := resolve(w.store, w.key)
+	if old, ok := w.cache.mp[name]; ok {
+		w.replaced = int64(len(old.data))
+	}
+	w.cache.mp[name] = &memdata{data: data, modTime: time.Now()}
+	return nil
+}
+
+var _ Replacer = &memwriter{}
+
+func (w *memwriter) Replaced() int64 {
+	return w.replaced
+}
+
+var _ Aborter = &memwriter{}
+
+func (w *memwriter) Abort() error {
+	w.buf.Reset()
 	return nil
 }
 
 func (c *MemCache) Writer(_ context.Context, store Store, key Key) (io.Writer, error) {
-	return &memwriter{buf: &bytes.Buffer{}, cache: c, store: store, key: key}, nil
+	return &memwriter{buf: &bytes.Buffer{}, cache: c, store: store, key: key, replaced: -1}, nil
 }
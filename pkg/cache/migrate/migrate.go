@@ -0,0 +1,139 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package migrate copies every entry from one cache to another.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/cache/scan"
+	"github.com/rs/zerolog"
+)
+
+type Options struct {
+	scan.Options
+	// SkipExisting leaves entries that already exist in the destination
+	// alone instead of overwriting them.
+	SkipExisting bool
+	// Progress is how often progress is logged. Zero disables it.
+	Progress time.Duration
+}
+
+type Report struct {
+	Copied   int64 `json:"copied"`
+	Bytes    int64 `json:"bytes"`
+	Existing int64 `json:"existing"`
+}
+
+// stores are copied CAS first so AC entries never refer to blobs that haven't
+// been copied yet.
+var stores = []cache.Store{cache.CAS, cache.AC}
+
+// Migrate copies every AC and CAS entry from one cache to another. Writes to
+// caches that finish them in the background are flushed after each batch, so
+// that nothing is counted or checkpointed before it's stored.
+func Migrate(ctx context.Context, from, to cache.Cache, opts Options) (Report, error) {
+	log := zerolog.Ctx(ctx)
+	report := &Report{}
+	opts.Sync = func(ctx context.Context) error {
+		if err := cache.Flush(ctx, to); err != nil {
+			return fmt.Errorf("migrate flush: %w", err)
+		}
+		return nil
+	}
+
+	if opts.Progress > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(opts.Progress)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					log.Info().
+						Int64("copied", atomic.LoadInt64(&report.Copied)).
+						Int64("bytes", atomic.LoadInt64(&report.Bytes)).
+						Int64("existing", atomic.LoadInt64(&report.Existing)).
+						Msg("migrate progress")
+				}
+			}
+		}()
+	}
+
+	err := scan.Scan(ctx, from, stores, opts.Options, func(ctx context.Context, store cache.Store, key cache.Key, _ cache.Info) error {
+		if opts.SkipExisting {
+			if err := to.Exists(ctx, store, key); err == nil {
+				atomic.AddInt64(&report.Existing, 1)
+				return nil
+			} else if !errors.Is(err, cache.ErrNotFound) {
+				return err
+			}
+		}
+
+		written, err := copyEntry(ctx, from, to, store, key)
+		if errors.Is(err, cache.ErrNotFound) {
+			// deleted since the walk found it
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("migrate %s/%s: %w", store, key, err)
+		}
+		log.Debug().Stringer("store", store).Stringer("key", key).Int64("size", written).Msg("migrate copied")
+		atomic.AddInt64(&report.Copied, 1)
+		atomic.AddInt64(&report.Bytes, written)
+		return nil
+	})
+	if err != nil {
+		// let what's in flight finish before giving up
+		cache.Flush(ctx, to)
+		return *report, err
+	}
+	return *report, opts.Sync(ctx)
+}
+
+func copyEntry(ctx context.Context, from, to cache.Cache, store cache.Store, key cache.Key) (int64, error) {
+	reader, size, err := from.Reader(ctx, store, key)
+	if err != nil {
+		return 0, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	writer, err := to.Writer(ctx, store, key)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(writer, io.LimitReader(reader, size))
+	if closer, ok := writer.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil && written != size {
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
+}
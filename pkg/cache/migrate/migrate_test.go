@@ -0,0 +1,103 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/cache/disk"
+	"github.com/dmorgan81/buzzel/pkg/cache/scan"
+	"github.com/stretchr/testify/assert"
+)
+
+func put(c cache.Cache, store cache.Store, key cache.Key, data string) {
+	w, _ := c.Writer(context.Background(), store, key)
+	io.WriteString(w, data)
+	w.(io.Closer).Close()
+}
+
+func get(c cache.Cache, store cache.Store, key cache.Key) string {
+	r, _, err := c.Reader(context.Background(), store, key)
+	if err != nil {
+		return ""
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+	data, _ := ioutil.ReadAll(r)
+	return string(data)
+}
+
+// failingFlusher is a cache whose writes fail once they're flushed.
+type failingFlusher struct {
+	cache.Cache
+}
+
+func (failingFlusher) Flush(context.Context) error {
+	return errors.New("upload failed")
+}
+
+func TestMigrate(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	from := disk.Cache(filepath.Join(dir, "from"))
+	put(from, cache.AC, "aa/aa", "action")
+	put(from, cache.CAS, "bb/bb", "blob")
+	put(from, cache.CAS, "cc/cc", "other blob")
+
+	to := cache.NewMemCache()
+	put(to, cache.CAS, "cc/cc", "stale")
+
+	report, err := Migrate(ctx, from, to, Options{Options: scan.Options{Parallel: 2}, SkipExisting: true})
+	assert.NoError(err)
+	assert.Equal(Report{Copied: 2, Bytes: 10, Existing: 1}, report)
+	assert.Equal("action", get(to, cache.AC, "aa/aa"))
+	assert.Equal("blob", get(to, cache.CAS, "bb/bb"))
+	assert.Equal("stale", get(to, cache.CAS, "cc/cc"))
+
+	report, err = Migrate(ctx, from, to, Options{})
+	assert.NoError(err)
+	assert.Equal(int64(3), report.Copied)
+	assert.Equal("other blob", get(to, cache.CAS, "cc/cc"))
+
+	// resuming after the CAS finished only copies the AC
+	checkpoint := filepath.Join(dir, "checkpoint")
+	assert.NoError(ioutil.WriteFile(checkpoint, []byte("cas/cc/cc\n"), 0600))
+	to = cache.NewMemCache()
+	report, err = Migrate(ctx, from, to, Options{Options: scan.Options{Checkpoint: checkpoint}})
+	assert.NoError(err)
+	assert.Equal(int64(1), report.Copied)
+	assert.Equal("action", get(to, cache.AC, "aa/aa"))
+	assert.Equal("", get(to, cache.CAS, "bb/bb"))
+
+	// nothing is checkpointed until it's flushed
+	_, err = Migrate(ctx, from, failingFlusher{cache.NewMemCache()}, Options{Options: scan.Options{Checkpoint: checkpoint}})
+	assert.Error(err)
+	_, err = os.Stat(checkpoint)
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"github.com/dmorgan81/buzzel/pkg/reapi"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The methods called on the remote, whose messages are encoded with package
+// reapi like the rest of buzzel's REAPI support rather than with generated
+// code.
+const (
+	findMissingBlobs   = "/build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs"
+	getActionResult    = "/build.bazel.remote.execution.v2.ActionCache/GetActionResult"
+	updateActionResult = "/build.bazel.remote.execution.v2.ActionCache/UpdateActionResult"
+	byteStreamRead     = "/google.bytestream.ByteStream/Read"
+	byteStreamWrite    = "/google.bytestream.ByteStream/Write"
+)
+
+// rawCodec passes messages through as the bytes they're encoded to.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// FindMissingBlobsRequest{instance_name = 1, blob_digests = 2}
+func encodeFindMissingBlobs(instance string, d reapi.Digest) []byte {
+	b := reapi.AppendString(nil, 1, instance)
+	return reapi.AppendDigest(b, 2, d)
+}
+
+// GetActionResultRequest{instance_name = 1, action_digest = 2}
+func encodeGetActionResult(instance string, d reapi.Digest) []byte {
+	b := reapi.AppendString(nil, 1, instance)
+	return reapi.AppendDigest(b, 2, d)
+}
+
+// UpdateActionResultRequest{instance_name = 1, action_digest = 2,
+// action_result = 3}
+func encodeUpdateActionResult(instance string, d reapi.Digest, result []byte) []byte {
+	b := reapi.AppendString(nil, 1, instance)
+	b = reapi.AppendDigest(b, 2, d)
+	return reapi.AppendBytes(b, 3, result)
+}
+
+// ReadRequest{resource_name = 1, read_offset = 2, read_limit = 3}
+func encodeRead(resource string, offset, limit int64) []byte {
+	b := reapi.AppendString(nil, 1, resource)
+	b = reapi.AppendVarint(b, 2, uint64(offset))
+	return reapi.AppendVarint(b, 3, uint64(limit))
+}
+
+// WriteRequest{resource_name = 1, write_offset = 2, finish_write = 3,
+// data = 10}
+func encodeWrite(resource string, offset int64, finish bool, data []byte) []byte {
+	b := reapi.AppendString(nil, 1, resource)
+	b = reapi.AppendVarint(b, 2, uint64(offset))
+	if finish {
+		b = reapi.AppendVarint(b, 3, 1)
+	}
+	return reapi.AppendBytes(b, 10, data)
+}
+
+// ReadResponse{data = 10}
+func decodeReadResponse(b []byte) ([]byte, error) {
+	v, found, err := reapi.Field(b, 10)
+	if err != nil || !found {
+		return nil, err
+	}
+	data, n := protowire.ConsumeBytes(v)
+	if n < 0 {
+		return nil, reapi.ErrMalformed
+	}
+	return data, nil
+}
+
+// WriteResponse{committed_size = 1}
+func decodeWriteResponse(b []byte) (int64, error) {
+	v, found, err := reapi.Field(b, 1)
+	if err != nil || !found {
+		return 0, err
+	}
+	size, n := protowire.ConsumeVarint(v)
+	if n < 0 {
+		return 0, reapi.ErrMalformed
+	}
+	return int64(size), nil
+}
+
+// FindMissingBlobsResponse{missing_blob_digests = 2}
+func decodeFindMissingBlobs(b []byte) (bool, error) {
+	_, found, err := reapi.Field(b, 2)
+	return found, err
+}
@@ -0,0 +1,457 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package remote is a cache backed by a remote cache that speaks the Bazel
+// Remote Execution API over gRPC, such as a hosted remote execution service.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/reapi"
+	health "github.com/etherlabsio/healthcheck/v2"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Options configures a Cache.
+type Options struct {
+	// Instance is the instance name sent with every request.
+	Instance string
+	// TLS connects over TLS rather than in plaintext.
+	TLS bool
+	// Metadata is sent with every request, such as an authorization header.
+	Metadata map[string]string
+	// Sizes is how many blob sizes to remember. By default it's a million.
+	Sizes int
+}
+
+// chunkSize is how much is sent with each ByteStream write.
+const chunkSize = 64 * 1024
+
+// Cache reads and writes the CAS through the ByteStream API and the AC
+// through the ActionCache API.
+//
+// The remote needs the size of every blob, which HTTP clients don't send, so
+// reads of CAS blobs whose size hasn't been learned from an action result,
+// tree or upload are misses. Action digests are sent with a size of zero,
+// which relies on the remote keying its action cache by hash alone.
+type Cache struct {
+	// unknown counts the reads missed because the size wasn't known. It
+	// comes first to keep it aligned for atomic access.
+	unknown int64
+	conn    *grpc.ClientConn
+	opts    Options
+	md      metadata.MD
+	sizes   *sizes
+}
+
+var _ cache.Cache = &Cache{}
+
+// New connects to the remote at target.
+func New(target string, opts Options) (*Cache, error) {
+	creds := grpc.WithInsecure()
+	if opts.TLS {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	}
+	conn, err := grpc.Dial(target, creds, grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+	if err != nil {
+		return nil, err
+	}
+	if opts.Sizes <= 0 {
+		opts.Sizes = 1 << 20
+	}
+	return &Cache{conn: conn, opts: opts, md: metadata.New(opts.Metadata), sizes: newSizes(opts.Sizes)}, nil
+}
+
+func (c *Cache) context(ctx context.Context) context.Context {
+	if len(c.md) == 0 {
+		return ctx
+	}
+	return metadata.NewOutgoingContext(ctx, c.md)
+}
+
+// translate maps gRPC errors onto the cache's.
+func translate(err error) error {
+	switch status.Code(err) {
+	case codes.OK:
+		return err
+	case codes.NotFound:
+		return cache.ErrNotFound
+	case codes.OutOfRange:
+		return cache.ErrInvalidRange
+	}
+	return err
+}
+
+func hash(key cache.Key) string {
+	return path.Base(string(key))
+}
+
+func (c *Cache) resource(d reapi.Digest) string {
+	name := fmt.Sprintf("blobs/%s/%d", d.Hash, d.Size)
+	if c.opts.Instance != "" {
+		name = c.opts.Instance + "/" + name
+	}
+	return name
+}
+
+func (c *Cache) uploadResource(d reapi.Digest) (string, error) {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		return "", err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	name := fmt.Sprintf("uploads/%x-%x-%x-%x-%x/blobs/%s/%d", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:], d.Hash, d.Size)
+	if c.opts.Instance != "" {
+		name = c.opts.Instance + "/" + name
+	}
+	return name, nil
+}
+
+// blob returns the digest of a CAS blob, or ErrNotFound if its size isn't
+// known. Those misses are logged with a running count, since they'd otherwise
+// look like the remote not having the blob.
+func (c *Cache) blob(ctx context.Context, key cache.Key) (blobSize, error) {
+	blob, ok := c.sizes.get(hash(key))
+	if !ok {
+		zerolog.Ctx(ctx).Info().
+			Stringer("key", key).
+			Int64("misses", atomic.AddInt64(&c.unknown, 1)).
+			Msg("blob size unknown")
+		return blobSize{}, cache.ErrNotFound
+	}
+	return blob, nil
+}
+
+func (c *Cache) actionResult(ctx context.Context, key cache.Key) ([]byte, error) {
+	req := encodeGetActionResult(c.opts.Instance, reapi.Digest{Hash: hash(key)})
+	var resp []byte
+	if err := c.conn.Invoke(c.context(ctx), getActionResult, &req, &resp); err != nil {
+		return nil, translate(err)
+	}
+	c.sizes.learnActionResult(resp)
+	return resp, nil
+}
+
+func (c *Cache) Exists(ctx context.Context, store cache.Store, key cache.Key) error {
+	_, err := c.Stat(ctx, store, key)
+	return err
+}
+
+// Stat reports no modification time, which the remote doesn't expose.
+func (c *Cache) Stat(ctx context.Context, store cache.Store, key cache.Key) (cache.Info, error) {
+	if store == cache.AC {
+		result, err := c.actionResult(ctx, key)
+		if err != nil {
+			return cache.Info{}, err
+		}
+		return cache.Info{Size: int64(len(result))}, nil
+	}
+
+	blob, err := c.blob(ctx, key)
+	if err != nil {
+		return cache.Info{}, err
+	}
+	req := encodeFindMissingBlobs(c.opts.Instance, reapi.Digest{Hash: blob.hash, Size: blob.size})
+	var resp []byte
+	if err := c.conn.Invoke(c.context(ctx), findMissingBlobs, &req, &resp); err != nil {
+		return cache.Info{}, translate(err)
+	}
+	missing, err := decodeFindMissingBlobs(resp)
+	if err != nil {
+		return cache.Info{}, err
+	}
+	if missing {
+		return cache.Info{}, cache.ErrNotFound
+	}
+	return cache.Info{Size: blob.size}, nil
+}
+
+func (c *Cache) Reader(ctx context.Context, store cache.Store, key cache.Key) (io.Reader, int64, error) {
+	if store == cache.AC {
+		result, err := c.actionResult(ctx, key)
+		if err != nil {
+			return nil, -1, err
+		}
+		return bytes.NewReader(result), int64(len(result)), nil
+	}
+
+	blob, err := c.blob(ctx, key)
+	if err != nil {
+		return nil, -1, err
+	}
+	if blob.tree {
+		// trees are small, and reading one teaches the sizes of its files
+		data, err := c.readAll(ctx, blob)
+		if err != nil {
+			return nil, -1, err
+		}
+		c.sizes.learnTree(data)
+		return bytes.NewReader(data), int64(len(data)), nil
+	}
+	r, err := c.read(ctx, blob, 0, 0)
+	if err != nil {
+		return nil, -1, err
+	}
+	return r, blob.size, nil
+}
+
+var _ cache.RangeReader = &Cache{}
+
+func (c *Cache) RangeReader(ctx context.Context, store cache.Store, key cache.Key, offset, length int64) (io.Reader, int64, error) {
+	if store == cache.AC {
+		result, err := c.actionResult(ctx, key)
+		if err != nil {
+			return nil, -1, err
+		}
+		return cache.SliceRange(result, offset, length)
+	}
+
+	blob, err := c.blob(ctx, key)
+	if err != nil {
+		return nil, -1, err
+	}
+	start, n, err := cache.ResolveRange(offset, length, blob.size)
+	if err != nil {
+		return nil, blob.size, err
+	}
+	r, err := c.read(ctx, blob, start, n)
+	if err != nil {
+		return nil, -1, err
+	}
+	return r, blob.size, nil
+}
+
+func (c *Cache) readAll(ctx context.Context, blob blobSize) ([]byte, error) {
+	r, err := c.read(ctx, blob, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// read streams a blob from offset, up to limit bytes unless it's zero. The
+// first response is waited for so that a missing blob is reported here.
+func (c *Cache) read(ctx context.Context, blob blobSize, offset, limit int64) (*streamReader, error) {
+	ctx, cancel := context.WithCancel(c.context(ctx))
+	stream, err := c.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, byteStreamRead)
+	if err != nil {
+		cancel()
+		return nil, translate(err)
+	}
+	req := encodeRead(c.resource(reapi.Digest{Hash: blob.hash, Size: blob.size}), offset, limit)
+	if err := stream.SendMsg(&req); err != nil {
+		cancel()
+		return nil, translate(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		cancel()
+		return nil, translate(err)
+	}
+
+	r := &streamReader{stream: stream, cancel: cancel}
+	if err := r.recv(); err != nil && err != io.EOF {
+		cancel()
+		return nil, err
+	}
+	return r, nil
+}
+
+// streamReader reads the data of a ByteStream read.
+type streamReader struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	buf    []byte
+	err    error
+}
+
+func (r *streamReader) recv() error {
+	for len(r.buf) == 0 && r.err == nil {
+		var resp []byte
+		if err := r.stream.RecvMsg(&resp); err != nil {
+			if err != io.EOF {
+				err = translate(err)
+			}
+			r.err = err
+			break
+		}
+		r.buf, r.err = decodeReadResponse(resp)
+	}
+	if len(r.buf) > 0 {
+		return nil
+	}
+	return r.err
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if err := r.recv(); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *streamReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// Writer buffers the entry in a temporary file, since the remote needs to
+// know the size of a blob before it's sent, and uploads it on Close.
+func (c *Cache) Writer(ctx context.Context, store cache.Store, key cache.Key) (io.Writer, error) {
+	file, err := ioutil.TempFile("", "buzzel-remote-*")
+	if err != nil {
+		return nil, err
+	}
+	return &writer{File: file, ctx: ctx, c: c, store: store, key: key}, nil
+}
+
+type writer struct {
+	*os.File
+	ctx   context.Context
+	c     *Cache
+	store cache.Store
+	key   cache.Key
+}
+
+func (w *writer) Close() error {
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+
+	size, err := w.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	d := reapi.Digest{Hash: hash(w.key), Size: size}
+
+	if w.store == cache.AC {
+		result, err := ioutil.ReadAll(w.File)
+		if err != nil {
+			return err
+		}
+		req := encodeUpdateActionResult(w.c.opts.Instance, d, result)
+		var resp []byte
+		if err := w.c.conn.Invoke(w.c.context(w.ctx), updateActionResult, &req, &resp); err != nil {
+			return translate(err)
+		}
+		w.c.sizes.learnActionResult(result)
+		return nil
+	}
+
+	if err := w.c.write(w.ctx, d, w.File); err != nil {
+		return err
+	}
+	w.c.sizes.put(d, false)
+	return nil
+}
+
+var _ cache.Aborter = &writer{}
+
+func (w *writer) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+// write uploads a blob through a ByteStream write.
+func (c *Cache) write(ctx context.Context, d reapi.Digest, r io.Reader) error {
+	resource, err := c.uploadResource(d)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(c.context(ctx))
+	defer cancel()
+	stream, err := c.conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true}, byteStreamWrite)
+	if err != nil {
+		return translate(err)
+	}
+
+	buf := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		finish := offset+int64(n) == d.Size
+		req := encodeWrite(resource, offset, finish, buf[:n])
+		// the resource name only needs to be sent first
+		resource = ""
+		if err := stream.SendMsg(&req); err == io.EOF {
+			// the remote already has the blob, or gave up; its status says
+			// which
+			break
+		} else if err != nil {
+			return translate(err)
+		}
+		offset += int64(n)
+		if finish {
+			break
+		}
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return translate(err)
+	}
+	var resp []byte
+	if err := stream.RecvMsg(&resp); err != nil {
+		return translate(err)
+	}
+	committed, err := decodeWriteResponse(resp)
+	if err != nil {
+		return err
+	}
+	if committed != d.Size && committed != -1 {
+		return fmt.Errorf("remote: committed %d of %d bytes", committed, d.Size)
+	}
+	return nil
+}
+
+var _ health.Checker = &Cache{}
+
+// Check fails while the connection to the remote is failing.
+func (c *Cache) Check(ctx context.Context) error {
+	switch state := c.conn.GetState(); state {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return fmt.Errorf("remote: connection %s", state)
+	}
+	return nil
+}
+
+// Close closes the connection to the remote.
+func (c *Cache) Close() error {
+	return c.conn.Close()
+}
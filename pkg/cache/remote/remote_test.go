@@ -0,0 +1,215 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/reapi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeRemote serves the parts of the REAPI the backend uses from maps.
+type fakeRemote struct {
+	lock sync.Mutex
+	cas  map[string][]byte
+	ac   map[string][]byte
+}
+
+func (f *fakeRemote) digest(req []byte) reapi.Digest {
+	v, _, _ := reapi.Field(req, 2)
+	b, _ := protowire.ConsumeBytes(v)
+	d, _ := reapi.DecodeDigest(b)
+	return d
+}
+
+func (f *fakeRemote) handle(srv interface{}, stream grpc.ServerStream) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if auth := md.Get("authorization"); len(auth) != 1 || auth[0] != "Bearer secret" {
+		return status.Error(codes.Unauthenticated, "no token")
+	}
+
+	method, _ := grpc.MethodFromServerStream(stream)
+	var req []byte
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch method {
+	case findMissingBlobs:
+		d := f.digest(req)
+		var resp []byte
+		if _, ok := f.cas[d.Hash]; !ok {
+			resp = reapi.AppendDigest(resp, 2, d)
+		}
+		return stream.SendMsg(&resp)
+	case getActionResult:
+		result, ok := f.ac[f.digest(req).Hash]
+		if !ok {
+			return status.Error(codes.NotFound, "not found")
+		}
+		return stream.SendMsg(&result)
+	case updateActionResult:
+		v, _, _ := reapi.Field(req, 3)
+		result, _ := protowire.ConsumeBytes(v)
+		f.ac[f.digest(req).Hash] = result
+		return stream.SendMsg(&result)
+	case byteStreamRead:
+		v, _, _ := reapi.Field(req, 1)
+		resource, _ := protowire.ConsumeString(v)
+		parts := strings.Split(resource, "/")
+		data, ok := f.cas[parts[len(parts)-2]]
+		if !ok {
+			return status.Error(codes.NotFound, "not found")
+		}
+		var offset, limit uint64
+		if v, ok, _ := reapi.Field(req, 2); ok {
+			offset, _ = protowire.ConsumeVarint(v)
+		}
+		if v, ok, _ := reapi.Field(req, 3); ok {
+			limit, _ = protowire.ConsumeVarint(v)
+		}
+		data = data[offset:]
+		if limit > 0 && int(limit) < len(data) {
+			data = data[:limit]
+		}
+		// a byte at a time to exercise reassembly
+		for i := range data {
+			resp := reapi.AppendBytes(nil, 10, data[i:i+1])
+			if err := stream.SendMsg(&resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	case byteStreamWrite:
+		v, _, _ := reapi.Field(req, 1)
+		resource, _ := protowire.ConsumeString(v)
+		parts := strings.Split(resource, "/")
+		var data []byte
+		for {
+			v, _, _ := reapi.Field(req, 10)
+			chunk, _ := protowire.ConsumeBytes(v)
+			data = append(data, chunk...)
+			if _, finish, _ := reapi.Field(req, 3); finish {
+				break
+			}
+			if err := stream.RecvMsg(&req); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		f.cas[parts[len(parts)-2]] = data
+		resp := reapi.AppendVarint(nil, 1, uint64(len(data)))
+		return stream.SendMsg(&resp)
+	}
+	return status.Error(codes.Unimplemented, method)
+}
+
+func TestCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	f := &fakeRemote{cas: make(map[string][]byte), ac: make(map[string][]byte)}
+	server := grpc.NewServer(grpc.UnknownServiceHandler(f.handle), grpc.ForceServerCodec(rawCodec{}))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	go server.Serve(lis)
+	defer server.Stop()
+
+	c, err := New(lis.Addr().String(), Options{Instance: "main", Metadata: map[string]string{"authorization": "Bearer secret"}})
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	read := func(r io.Reader, err error) string {
+		if !assert.NoError(err) {
+			return ""
+		}
+		b, _ := ioutil.ReadAll(r)
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+		return string(b)
+	}
+
+	w, err := c.Writer(ctx, cache.CAS, "aa/aaaa")
+	if assert.NoError(err) {
+		w.Write([]byte("test"))
+		assert.NoError(w.(io.Closer).Close())
+	}
+	assert.Equal([]byte("test"), f.cas["aaaa"])
+
+	info, err := c.Stat(ctx, cache.CAS, "aa/aaaa")
+	assert.NoError(err)
+	assert.Equal(int64(4), info.Size)
+	r, size, err := c.Reader(ctx, cache.CAS, "aa/aaaa")
+	assert.Equal("test", read(r, err))
+	assert.Equal(int64(4), size)
+	r, _, err = c.RangeReader(ctx, cache.CAS, "aa/aaaa", 1, 2)
+	assert.Equal("es", read(r, err))
+	r, _, err = c.RangeReader(ctx, cache.CAS, "aa/aaaa", -1, -1)
+	assert.Equal("t", read(r, err))
+	_, _, err = c.RangeReader(ctx, cache.CAS, "aa/aaaa", 4, -1)
+	assert.True(errors.Is(err, cache.ErrInvalidRange))
+
+	// blobs are misses until their size is known from an action result
+	f.cas["bbbb"] = []byte("output")
+	assert.True(errors.Is(c.Exists(ctx, cache.CAS, "bb/bbbb"), cache.ErrNotFound))
+	assert.Equal(int64(1), c.unknown)
+	assert.True(errors.Is(c.Exists(ctx, cache.AC, "cc/cccc"), cache.ErrNotFound))
+
+	var file []byte
+	file = reapi.AppendString(file, 1, "out")
+	file = reapi.AppendDigest(file, 2, reapi.Digest{Hash: "bbbb", Size: 6})
+	result := reapi.AppendBytes(nil, 2, file)
+	w, err = c.Writer(ctx, cache.AC, "cc/cccc")
+	if assert.NoError(err) {
+		w.Write(result)
+		assert.NoError(w.(io.Closer).Close())
+	}
+	c.sizes = newSizes(10)
+	r, size, err = c.Reader(ctx, cache.AC, "cc/cccc")
+	assert.Equal(string(result), read(r, err))
+	assert.Equal(int64(len(result)), size)
+	r, _, err = c.Reader(ctx, cache.CAS, "bb/bbbb")
+	assert.Equal("output", read(r, err))
+
+	// the empty blob's size is always known
+	f.cas[emptyHash] = nil
+	assert.NoError(c.Exists(ctx, cache.CAS, cache.Key("e3/"+emptyHash)))
+
+	c.md = metadata.New(nil)
+	assert.Error(c.Exists(ctx, cache.AC, "cc/cccc"))
+}
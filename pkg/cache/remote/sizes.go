@@ -0,0 +1,114 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/dmorgan81/buzzel/pkg/reapi"
+)
+
+// emptyHash is the SHA-256 hash of the empty blob, whose size is always known.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sizes remembers the sizes of blobs, which the remote needs to be told but
+// HTTP clients never send. They're learned from the action results and trees
+// that pass through and from uploads. The least recently used are forgotten
+// once there are max of them.
+type sizes struct {
+	lock  sync.Mutex
+	max   int
+	order *list.List
+	blobs map[string]*list.Element
+}
+
+type blobSize struct {
+	hash string
+	size int64
+	// tree marks blobs referenced as Trees, whose files are learned when
+	// they're read
+	tree bool
+}
+
+func newSizes(max int) *sizes {
+	return &sizes{max: max, order: list.New(), blobs: make(map[string]*list.Element)}
+}
+
+func (s *sizes) get(hash string) (blobSize, bool) {
+	if hash == emptyHash {
+		return blobSize{hash: hash}, true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.blobs[hash]
+	if !ok {
+		return blobSize{}, false
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(blobSize), true
+}
+
+func (s *sizes) put(d reapi.Digest, tree bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.blobs[d.Hash]; ok {
+		blob := e.Value.(blobSize)
+		e.Value = blobSize{hash: d.Hash, size: d.Size, tree: tree || blob.tree}
+		s.order.MoveToFront(e)
+		return
+	}
+
+	s.blobs[d.Hash] = s.order.PushFront(blobSize{hash: d.Hash, size: d.Size, tree: tree})
+	for s.order.Len() > s.max {
+		e := s.order.Back()
+		s.order.Remove(e)
+		delete(s.blobs, e.Value.(blobSize).hash)
+	}
+}
+
+// learnActionResult remembers the sizes of the blobs an encoded ActionResult
+// references.
+func (s *sizes) learnActionResult(b []byte) {
+	ar, err := reapi.DecodeActionResult(b)
+	if err != nil {
+		return
+	}
+	for _, d := range ar.Files {
+		s.put(d, false)
+	}
+	for _, d := range ar.Directories {
+		s.put(d, false)
+	}
+	for _, d := range ar.Trees {
+		s.put(d, true)
+	}
+}
+
+// learnTree remembers the sizes of the blobs an encoded Tree references.
+func (s *sizes) learnTree(b []byte) {
+	tree, err := reapi.DecodeTree(b)
+	if err != nil {
+		return
+	}
+	for _, d := range tree.Files {
+		s.put(d, false)
+	}
+	for _, d := range tree.Directories {
+		s.put(d, false)
+	}
+}
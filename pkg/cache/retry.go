@@ -0,0 +1,316 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	health "github.com/etherlabsio/healthcheck/v2"
+	"github.com/rs/zerolog"
+)
+
+// RetryOptions configures a Retry.
+type RetryOptions struct {
+	// Attempts is how many times a read is tried in all.
+	Attempts int
+	// Backoff is the most to wait before the first retry, doubling with each
+	// one up to MaxBackoff. The actual wait is a random fraction of that.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// HedgeAfter is how long to wait for a read before starting a second one
+	// and taking whichever answers first, unless it's zero. With
+	// HedgePercentile set, the wait is that percentile of recent reads
+	// instead once there are enough of them to tell, but no less than
+	// HedgeAfter.
+	HedgeAfter      time.Duration
+	HedgePercentile float64
+}
+
+// hedgeSamples is how many recent read latencies are kept to work out when to
+// hedge, and hedgeMinSamples how many are needed first.
+const (
+	hedgeSamples    = 1000
+	hedgeMinSamples = 100
+)
+
+// Retry retries the reads of a cache that fail for reasons other than the
+// entry not being there, and can hedge slow ones. Writes can't be replayed
+// and are passed straight through.
+type Retry struct {
+	cache Cache
+	opts  RetryOptions
+
+	lock      sync.Mutex
+	latencies []time.Duration
+	next      int
+	threshold time.Duration
+}
+
+var _ Cache = &Retry{}
+
+func NewRetry(cache Cache, opts RetryOptions) *Retry {
+	if opts.Attempts < 1 {
+		opts.Attempts = 1
+	}
+	return &Retry{cache: cache, opts: opts, threshold: opts.HedgeAfter}
+}
+
+// retryable reports whether a read that failed with err is worth trying
+// again.
+func retryable(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == nil &&
+		!errors.Is(err, ErrNotFound) &&
+		!errors.Is(err, ErrInvalidRange) &&
+		!errors.Is(err, ErrNotSupported) &&
+		!errors.Is(err, ErrBreakerOpen)
+}
+
+// do calls fn until it succeeds, fails for good or runs out of attempts.
+func (c *Retry) do(ctx context.Context, op string, fn func() error) error {
+	backoff := c.opts.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if attempt >= c.opts.Attempts || !retryable(ctx, err) {
+			return err
+		}
+
+		wait := time.Duration(0)
+		if backoff > 0 {
+			wait = time.Duration(rand.Int63n(int64(backoff)))
+		}
+		zerolog.Ctx(ctx).Debug().Err(err).
+			Str("op", op).
+			Int("attempt", attempt).
+			Dur("wait", wait).
+			Msg("cache retry")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+		if c.opts.MaxBackoff > 0 && backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+func (c *Retry) Exists(ctx context.Context, store Store, key Key) error {
+	return c.do(ctx, "exists", func() error {
+		return c.cache.Exists(ctx, store, key)
+	})
+}
+
+func (c *Retry) Stat(ctx context.Context, store Store, key Key) (info Info, err error) {
+	err = c.do(ctx, "stat", func() error {
+		info, err = c.cache.Stat(ctx, store, key)
+		return err
+	})
+	return info, err
+}
+
+func (c *Retry) Reader(ctx context.Context, store Store, key Key) (reader io.Reader, size int64, err error) {
+	err = c.do(ctx, "read", func() error {
+		reader, size, err = c.hedge(ctx, func(ctx context.Context) (io.Reader, int64, error) {
+			return c.cache.Reader(ctx, store, key)
+		})
+		return err
+	})
+	return reader, size, err
+}
+
+var _ RangeReader = &Retry{}
+
+func (c *Retry) RangeReader(ctx context.Context, store Store, key Key, offset, length int64) (reader io.Reader, size int64, err error) {
+	err = c.do(ctx, "read range", func() error {
+		reader, size, err = c.hedge(ctx, func(ctx context.Context) (io.Reader, int64, error) {
+			return ReadRange(ctx, c.cache, store, key, offset, length)
+		})
+		return err
+	})
+	return reader, size, err
+}
+
+// observe records how long a read took to answer and works out the new
+// hedging threshold.
+func (c *Retry) observe(latency time.Duration) {
+	if c.opts.HedgePercentile <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.latencies) < hedgeSamples {
+		c.latencies = append(c.latencies, latency)
+	} else {
+		c.latencies[c.next] = latency
+		c.next = (c.next + 1) % hedgeSamples
+	}
+	if len(c.latencies) < hedgeMinSamples {
+		return
+	}
+
+	sorted := append([]time.Duration(nil), c.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	threshold := sorted[int(float64(len(sorted)-1)*c.opts.HedgePercentile)]
+	if threshold < c.opts.HedgeAfter {
+		threshold = c.opts.HedgeAfter
+	}
+	c.threshold = threshold
+}
+
+func (c *Retry) hedgeAfter() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.threshold
+}
+
+type readResult struct {
+	reader io.Reader
+	size   int64
+	err    error
+	cancel context.CancelFunc
+}
+
+// hedge calls read, and again if the first call is slower than the hedging
+// threshold, returning whichever answers first. The other is cancelled.
+func (c *Retry) hedge(ctx context.Context, read func(context.Context) (io.Reader, int64, error)) (io.Reader, int64, error) {
+	after := c.hedgeAfter()
+	start := time.Now()
+	if after <= 0 && c.opts.HedgePercentile <= 0 {
+		return read(ctx)
+	}
+
+	results := make(chan readResult, 2)
+	launch := func() {
+		ctx, cancel := context.WithCancel(ctx)
+		go func() {
+			reader, size, err := read(ctx)
+			results <- readResult{reader, size, err, cancel}
+		}()
+	}
+	launch()
+	pending := 1
+
+	var timer <-chan time.Time
+	if after > 0 {
+		t := time.NewTimer(after)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	var result readResult
+	for {
+		select {
+		case <-timer:
+			zerolog.Ctx(ctx).Debug().Dur("after", after).Msg("cache hedge")
+			launch()
+			pending++
+			timer = nil
+			continue
+		case result = <-results:
+			pending--
+		}
+		// a miss or bad range is as good an answer as any
+		if result.err == nil || !retryable(ctx, result.err) || pending == 0 {
+			break
+		}
+		// wait on the other read
+		result.cancel()
+	}
+	c.observe(time.Since(start))
+
+	// the loser is cancelled and cleaned up whenever it answers
+	for ; pending > 0; pending-- {
+		go func() {
+			loser := <-results
+			loser.cancel()
+			if closer, ok := loser.reader.(io.Closer); ok {
+				closer.Close()
+			}
+		}()
+	}
+
+	if result.err != nil {
+		result.cancel()
+		return nil, -1, result.err
+	}
+	// the winner's context lives as long as its reader
+	return cancelReader{result.reader, result.cancel}, result.size, nil
+}
+
+// cancelReader cancels the context of a read when it's closed.
+type cancelReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (r cancelReader) Unwrap() io.Reader {
+	return r.Reader
+}
+
+func (r cancelReader) Close() error {
+	defer r.cancel()
+	if closer, ok := r.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *Retry) Writer(ctx context.Context, store Store, key Key) (io.Writer, error) {
+	return c.cache.Writer(ctx, store, key)
+}
+
+var _ Deleter = &Retry{}
+
+func (c *Retry) Delete(ctx context.Context, store Store, key Key) error {
+	return Delete(ctx, c.cache, store, key)
+}
+
+var _ Walker = &Retry{}
+
+func (c *Retry) Walk(ctx context.Context, store Store, fn WalkFunc) error {
+	return Walk(ctx, c.cache, store, fn)
+}
+
+var _ SeekWalker = &Retry{}
+
+func (c *Retry) WalkAfter(ctx context.Context, store Store, after Key, fn WalkFunc) error {
+	return WalkAfter(ctx, c.cache, store, after, fn)
+}
+
+var _ Flusher = &Retry{}
+
+func (c *Retry) Flush(ctx context.Context) error {
+	return Flush(ctx, c.cache)
+}
+
+var _ health.Checker = &Retry{}
+
+func (c *Retry) Check(ctx context.Context) error {
+	if checker, ok := c.cache.(health.Checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unreliableCache fails the first reads it's asked for and is slow for the
+// ones after that until told otherwise.
+type unreliableCache struct {
+	Cache
+	failures int32
+	slow     int32
+	reads    int32
+}
+
+func (c *unreliableCache) Reader(ctx context.Context, store Store, key Key) (io.Reader, int64, error) {
+	n := atomic.AddInt32(&c.reads, 1)
+	if n <= atomic.LoadInt32(&c.failures) {
+		return nil, -1, errFlaky
+	}
+	if n <= atomic.LoadInt32(&c.slow) {
+		select {
+		case <-ctx.Done():
+			return nil, -1, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return c.Cache.Reader(ctx, store, key)
+}
+
+func TestRetry(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mem := NewMemCache()
+	w, _ := mem.Writer(ctx, CAS, "a")
+	w.Write([]byte("foo"))
+	w.(io.Closer).Close()
+
+	read := func(c Cache) (string, error) {
+		r, _, err := c.Reader(ctx, CAS, "a")
+		if err != nil {
+			return "", err
+		}
+		if closer, ok := r.(io.Closer); ok {
+			defer closer.Close()
+		}
+		b, err := ioutil.ReadAll(r)
+		return string(b), err
+	}
+
+	unreliable := &unreliableCache{Cache: mem, failures: 2}
+	c := NewRetry(unreliable, RetryOptions{Attempts: 3, Backoff: time.Millisecond})
+	data, err := read(c)
+	assert.NoError(err)
+	assert.Equal("foo", data)
+	assert.Equal(int32(3), unreliable.reads)
+
+	// misses aren't retried
+	_, _, err = c.Reader(ctx, CAS, "b")
+	assert.True(errors.Is(err, ErrNotFound))
+	assert.Equal(int32(4), unreliable.reads)
+
+	unreliable = &unreliableCache{Cache: mem, failures: 3}
+	c = NewRetry(unreliable, RetryOptions{Attempts: 3})
+	_, err = read(c)
+	assert.Equal(errFlaky, err)
+
+	// a slow read is hedged by a second one
+	unreliable = &unreliableCache{Cache: mem, slow: 1}
+	c = NewRetry(unreliable, RetryOptions{HedgeAfter: 10 * time.Millisecond})
+	start := time.Now()
+	data, err = read(c)
+	assert.NoError(err)
+	assert.Equal("foo", data)
+	assert.Less(int64(time.Since(start)), int64(time.Second/2))
+	assert.Equal(int32(2), atomic.LoadInt32(&unreliable.reads))
+}
+
+func TestRetryHedgePercentile(t *testing.T) {
+	assert := assert.New(t)
+	c := NewRetry(NewMemCache(), RetryOptions{HedgeAfter: time.Millisecond, HedgePercentile: 0.95})
+	for i := 1; i <= 100; i++ {
+		c.observe(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(95*time.Millisecond, c.hedgeAfter())
+}
@@ -18,9 +18,14 @@ package s3
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
@@ -34,20 +39,43 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// Options configures a Cache.
+type Options struct {
+	// Uploads is how many uploads are sent to S3 at once. By default it's
+	// one.
+	Uploads int
+	// NoReadRetries turns off the SDK's own retries of reads, for when a
+	// cache.Retry in front retries them, whose attempts would otherwise be
+	// multiplied by the SDK's. Writes, deletes and walks, which it leaves
+	// alone, are still retried by the SDK.
+	NoReadRetries bool
+}
+
 type Cache struct {
 	bucket  string
 	client  *s3.Client
 	uploads chan *upload
+	// reads are the options of read requests
+	reads []func(*s3.Options)
+
+	// pending counts uploads that haven't finished yet; idle is closed
+	// whenever there are none. failed counts the uploads that failed since
+	// the last Flush.
+	lock    sync.Mutex
+	pending int
+	idle    chan struct{}
+	failed  int
 }
 
 type upload struct {
-	ctx context.Context
-	in  *s3.PutObjectInput
+	ctx    context.Context
+	cancel context.CancelFunc
+	in     *s3.PutObjectInput
 }
 
 var _ cache.Cache = &Cache{}
 
-func NewCache(bucket string) (*Cache, error) {
+func NewCache(bucket string, opts Options) (*Cache, error) {
 	cfg, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
 		return nil, err
@@ -62,20 +90,80 @@ func NewCache(bucket string) (*Cache, error) {
 		return nil, err
 	}
 
-	uploads := make(chan *upload)
-	go func() {
-		uploader := manager.NewUploader(client)
-		for upload := range uploads {
-			// we don't want to use the upload ctx because the actual
-			// upload to S3 is asynchronous from the client's POV
-			if _, err := uploader.Upload(context.TODO(), upload.in); err != nil {
-				log := zerolog.Ctx(upload.ctx).With().Caller().Logger()
-				log.Err(err).Send()
+	idle := make(chan struct{})
+	close(idle)
+	c := &Cache{bucket: bucket, client: client, uploads: make(chan *upload), idle: idle}
+	if opts.Uploads < 1 {
+		opts.Uploads = 1
+	}
+	if opts.NoReadRetries {
+		c.reads = append(c.reads, func(o *s3.Options) {
+			o.Retryer = aws.NopRetryer{}
+		})
+	}
+	uploader := manager.NewUploader(client)
+	for i := 0; i < opts.Uploads; i++ {
+		go func() {
+			for upload := range c.uploads {
+				_, err := uploader.Upload(upload.ctx, upload.in)
+				if err != nil {
+					log := zerolog.Ctx(upload.ctx).With().Caller().Logger()
+					log.Err(err).Send()
+				}
+				upload.cancel()
+				c.done(err)
 			}
-		}
-	}()
+		}()
+	}
+
+	return c, nil
+}
+
+func (c *Cache) begin() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.pending == 0 {
+		c.idle = make(chan struct{})
+	}
+	c.pending++
+}
+
+func (c *Cache) done(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// aborted writes and clients that went away aren't failures
+	if err != nil && !errors.Is(err, errAborted) && !errors.Is(err, context.Canceled) {
+		c.failed++
+	}
+	c.pending--
+	if c.pending == 0 {
+		close(c.idle)
+	}
+}
+
+var _ cache.Flusher = &Cache{}
+
+// Flush waits for uploads that are still being sent to S3 after their writers
+// were closed. It fails if any upload has failed since the last Flush.
+func (c *Cache) Flush(ctx context.Context) error {
+	c.lock.Lock()
+	idle := c.idle
+	c.lock.Unlock()
 
-	return &Cache{bucket, client, uploads}, nil
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	failed := c.failed
+	c.failed = 0
+	if failed > 0 {
+		return fmt.Errorf("s3 cache: %d uploads failed", failed)
+	}
+	return nil
 }
 
 func resolve(store cache.Store, key cache.Key) string {
@@ -90,7 +178,7 @@ func (c *Cache) Exists(ctx context.Context, store cache.Store, key cache.Key) er
 	if _, err := c.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(c.bucket),
 		Key:    aws.String(path),
-	}); err != nil {
+	}, c.reads...); err != nil {
 		var awserr *awshttp.ResponseError
 		if errors.As(err, &awserr) && awserr.HTTPStatusCode() == http.StatusNotFound {
 			return cache.ErrNotFound
@@ -100,6 +188,25 @@ func (c *Cache) Exists(ctx context.Context, store cache.Store, key cache.Key) er
 	return nil
 }
 
+func (c *Cache) Stat(ctx context.Context, store cache.Store, key cache.Key) (cache.Info, error) {
+	path := resolve(store, key)
+	log := zerolog.Ctx(ctx).With().Caller().Logger()
+	log.Debug().Str("path", path).Send()
+
+	out, err := c.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(path),
+	}, c.reads...)
+	if err != nil {
+		var awserr *awshttp.ResponseError
+		if errors.As(err, &awserr) && awserr.HTTPStatusCode() == http.StatusNotFound {
+			return cache.Info{}, cache.ErrNotFound
+		}
+		return cache.Info{}, err
+	}
+	return cache.Info{Size: out.ContentLength, ModTime: aws.ToTime(out.LastModified)}, nil
+}
+
 func (c *Cache) Reader(ctx context.Context, store cache.Store, key cache.Key) (io.Reader, int64, error) {
 	path := resolve(store, key)
 	log := zerolog.Ctx(ctx).With().Caller().Logger()
@@ -108,7 +215,7 @@ func (c *Cache) Reader(ctx context.Context, store cache.Store, key cache.Key) (i
 	out, err := c.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(c.bucket),
 		Key:    aws.String(path),
-	})
+	}, c.reads...)
 	if err != nil {
 		var nsk *types.NoSuchKey
 		if errors.As(err, &nsk) {
@@ -120,14 +227,64 @@ func (c *Cache) Reader(ctx context.Context, store cache.Store, key cache.Key) (i
 	return out.Body, out.ContentLength, nil
 }
 
+var _ cache.RangeReader = &Cache{}
+
+func (c *Cache) RangeReader(ctx context.Context, store cache.Store, key cache.Key, offset, length int64) (io.Reader, int64, error) {
+	path := resolve(store, key)
+	log := zerolog.Ctx(ctx).With().Caller().Logger()
+
+	var rng string
+	switch {
+	case offset < 0:
+		rng = fmt.Sprintf("bytes=%d", offset)
+	case length < 0:
+		rng = fmt.Sprintf("bytes=%d-", offset)
+	default:
+		rng = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+	log.Debug().Str("path", path).Str("range", rng).Send()
+
+	out, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(path),
+		Range:  aws.String(rng),
+	}, c.reads...)
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, -1, cache.ErrNotFound
+		}
+		var awserr *awshttp.ResponseError
+		if errors.As(err, &awserr) && awserr.HTTPStatusCode() == http.StatusRequestedRangeNotSatisfiable {
+			return nil, -1, cache.ErrInvalidRange
+		}
+		return nil, -1, err
+	}
+
+	// Content-Range looks like "bytes 0-99/200"
+	size := out.ContentLength
+	if cr := aws.ToString(out.ContentRange); cr != "" {
+		if i := strings.LastIndexByte(cr, '/'); i >= 0 {
+			if total, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				size = total
+			}
+		}
+	}
+	return out.Body, size, nil
+}
+
 func (c *Cache) Writer(ctx context.Context, store cache.Store, key cache.Key) (io.Writer, error) {
 	path := resolve(store, key)
 	log := zerolog.Ctx(ctx).With().Caller().Logger()
 	log.Debug().Str("path", path).Send()
 
+	// the upload to S3 finishes after the writer is closed, so it can't be
+	// cancelled along with ctx, but it keeps ctx's deadline
+	uploadCtx, cancel := detach(ctx)
 	pr, pw := io.Pipe()
-	c.uploads <- &upload{
-		ctx: ctx,
+	up := &upload{
+		ctx:    uploadCtx,
+		cancel: cancel,
 		in: &s3.PutObjectInput{
 			Bucket:      aws.String(c.bucket),
 			Key:         aws.String(path),
@@ -135,7 +292,123 @@ func (c *Cache) Writer(ctx context.Context, store cache.Store, key cache.Key) (i
 			Body:        pr,
 		},
 	}
-	return pw, nil
+	c.begin()
+	select {
+	case c.uploads <- up:
+	case <-ctx.Done():
+		c.done(nil)
+		cancel()
+		return nil, ctx.Err()
+	}
+
+	w := &writer{PipeWriter: pw, closed: make(chan struct{})}
+	go w.watch(ctx)
+	return w, nil
+}
+
+// detach returns a context with the values and deadline of ctx that isn't
+// cancelled when ctx is.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.Context(detachedContext{ctx})
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithCancel(detached)
+}
+
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// errAborted fails uploads whose writer was aborted so that nothing is stored.
+var errAborted = errors.New("s3 cache: upload aborted")
+
+type writer struct {
+	*io.PipeWriter
+	once   sync.Once
+	closed chan struct{}
+}
+
+// watch fails the upload if ctx is done before the writer is closed, such as
+// when the client goes away part way through.
+func (w *writer) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		w.CloseWithError(ctx.Err())
+	case <-w.closed:
+	}
+}
+
+func (w *writer) Close() error {
+	w.once.Do(func() { close(w.closed) })
+	return w.PipeWriter.Close()
+}
+
+var _ cache.Aborter = &writer{}
+
+func (w *writer) Abort() error {
+	w.once.Do(func() { close(w.closed) })
+	return w.CloseWithError(errAborted)
+}
+
+var _ cache.Deleter = &Cache{}
+
+func (c *Cache) Delete(ctx context.Context, store cache.Store, key cache.Key) error {
+	path := resolve(store, key)
+	log := zerolog.Ctx(ctx).With().Caller().Logger()
+	log.Debug().Str("path", path).Send()
+
+	// deleting a missing object succeeds, so look for it first to report
+	// ErrNotFound like the other caches
+	if err := c.Exists(ctx, store, key); err != nil {
+		return err
+	}
+	_, err := c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(path),
+	})
+	return err
+}
+
+var _ cache.Walker = &Cache{}
+
+func (c *Cache) Walk(ctx context.Context, store cache.Store, fn cache.WalkFunc) error {
+	return c.WalkAfter(ctx, store, "", fn)
+}
+
+var _ cache.SeekWalker = &Cache{}
+
+func (c *Cache) WalkAfter(ctx context.Context, store cache.Store, after cache.Key, fn cache.WalkFunc) error {
+	prefix := string(store) + "/"
+	log := zerolog.Ctx(ctx).With().Caller().Logger()
+	log.Debug().Str("prefix", prefix).Stringer("after", after).Send()
+
+	in := &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(prefix),
+	}
+	if after != "" {
+		in.StartAfter = aws.String(prefix + string(after))
+	}
+
+	pages := s3.NewListObjectsV2Paginator(c.client, in)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			key := cache.Key(strings.TrimPrefix(aws.ToString(obj.Key), prefix))
+			if err := fn(key, cache.Info{Size: obj.Size, ModTime: aws.ToTime(obj.LastModified)}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 var _ health.Checker = &Cache{}
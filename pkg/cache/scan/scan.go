@@ -0,0 +1,206 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scan visits every entry of a cache in parallel, with a checkpoint
+// so that long scans can be resumed.
+package scan
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/rs/zerolog"
+)
+
+type Options struct {
+	// Parallel is how many entries are visited at once.
+	Parallel int
+	// Checkpoint is a file recording progress so an interrupted scan can
+	// resume where it left off. It's removed once a scan completes.
+	Checkpoint string
+	// Sync, if set, is called after each batch before the checkpoint is
+	// written, such as to wait for writes that finish in the background. A
+	// batch isn't done until it succeeds.
+	Sync func(ctx context.Context) error
+}
+
+// Func is called for each entry. It's called from several goroutines at once.
+type Func func(ctx context.Context, store cache.Store, key cache.Key, info cache.Info) error
+
+// batchSize is how many entries per goroutine are visited between checkpoints.
+const batchSize = 16
+
+type item struct {
+	key  cache.Key
+	info cache.Info
+}
+
+// Scan walks each store of c in turn and calls fn for every entry. Entries are
+// visited in batches, and the checkpoint is written after each batch with the
+// last key of the batch; walks are in key order so everything up to it is
+// done.
+func Scan(ctx context.Context, c cache.Cache, stores []cache.Store, opts Options, fn Func) error {
+	log := zerolog.Ctx(ctx)
+	if opts.Parallel < 1 {
+		opts.Parallel = 1
+	}
+
+	resumeStore, resumeKey, err := readCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return err
+	}
+	if resumeStore != "" {
+		log.Info().Stringer("store", resumeStore).Stringer("key", resumeKey).Msg("scan resuming")
+	}
+	done := resumeStore == ""
+
+	for _, store := range stores {
+		if !done && store != resumeStore {
+			// finished before the checkpoint was written
+			continue
+		}
+
+		resume := cache.Key("")
+		if !done {
+			resume, done = resumeKey, true
+		}
+
+		batch := make([]item, 0, opts.Parallel*batchSize)
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := visit(ctx, store, batch, opts.Parallel, fn); err != nil {
+				return err
+			}
+			if opts.Sync != nil {
+				if err := opts.Sync(ctx); err != nil {
+					return err
+				}
+			}
+			if err := writeCheckpoint(opts.Checkpoint, store, batch[len(batch)-1].key); err != nil {
+				return err
+			}
+			batch = batch[:0]
+			return nil
+		}
+
+		if err := cache.WalkAfter(ctx, c, store, resume, func(key cache.Key, info cache.Info) error {
+			batch = append(batch, item{key, info})
+			if len(batch) == cap(batch) {
+				return flush()
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Checkpoint != "" {
+		if err := os.Remove(opts.Checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func visit(ctx context.Context, store cache.Store, batch []item, parallel int, fn Func) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	items := make(chan item)
+	errs := make(chan error, parallel)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range items {
+				if err := fn(ctx, store, it.key, it.info); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+loop:
+	for _, it := range batch {
+		select {
+		case items <- it:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(items)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func readCheckpoint(file string) (cache.Store, cache.Key, error) {
+	if file == "" {
+		return "", "", nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	checkpoint := strings.TrimSpace(string(data))
+	i := strings.IndexByte(checkpoint, '/')
+	if i < 0 {
+		return "", "", errors.New("scan: malformed checkpoint " + checkpoint)
+	}
+	return cache.Store(checkpoint[:i]), cache.Key(checkpoint[i+1:]), nil
+}
+
+func writeCheckpoint(file string, store cache.Store, key cache.Key) error {
+	if file == "" {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(path.Join(string(store), string(key)) + "\n"); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -16,23 +16,99 @@ limitations under the License.
 package cache
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
 	health "github.com/etherlabsio/healthcheck/v2"
 	"github.com/justinas/alice"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
 )
 
-func NewServer(addr string, cache Cache) *http.Server {
-	chain := alice.New(hlog.NewHandler(log.Logger), gziphandler.GzipHandler)
+// Option configures the server returned by NewServer.
+type Option func(*options)
+
+type options struct {
+	adminToken  *Token
+	stats       *Stats
+	readyChecks map[string]health.Checker
+	limits      *Limits
+	maxSize     map[Store]int64
+	middleware  []alice.Constructor
+	compress    *CompressOptions
+}
+
+// WithAdminToken enables the admin API, which requires requests to present
+// token as a bearer token.
+func WithAdminToken(token *Token) Option {
+	return func(o *options) {
+		o.adminToken = token
+	}
+}
+
+// WithStats records client hits and misses in stats and serves its report
+// from the admin API.
+func WithStats(stats *Stats) Option {
+	return func(o *options) {
+		o.stats = stats
+	}
+}
+
+// WithReadyCheck adds checker to the checks made by /readyz.
+func WithReadyCheck(name string, checker health.Checker) Option {
+	return func(o *options) {
+		o.readyChecks[name] = checker
+	}
+}
+
+// WithLimits limits the rate and concurrency of each client's requests to the
+// stores.
+func WithLimits(limits Limits) Option {
+	return func(o *options) {
+		o.limits = &limits
+	}
+}
+
+// WithMaxSize rejects uploads to store that are larger than max bytes.
+func WithMaxSize(store Store, max int64) Option {
+	return func(o *options) {
+		o.maxSize[store] = max
+	}
+}
+
+// WithMiddleware adds middleware to the handlers of the stores, run after
+// any limits.
+func WithMiddleware(middleware ...alice.Constructor) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, middleware...)
+	}
+}
+
+// WithCompression compresses entries for clients that accept it.
+func WithCompression(opts CompressOptions) Option {
+	return func(o *options) {
+		o.compress = &opts
+	}
+}
+
+func NewServer(addr string, cache Cache, opts ...Option) *http.Server {
+	o := &options{readyChecks: make(map[string]health.Checker), maxSize: make(map[Store]int64)}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	chain := alice.New(hlog.NewHandler(log.Logger))
 	chain = chain.Append(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
 		hlog.FromRequest(r).Info().
 			Str("method", r.Method).
@@ -42,22 +118,79 @@ func NewServer(addr string, cache Cache) *http.Server {
 			Dur("duration", duration).
 			Msg("")
 	}))
+	acChain, casChain := chain, chain
+	if o.limits != nil {
+		l := newLimiter(*o.limits)
+		acChain, casChain = chain.Append(l.middleware(AC)), chain.Append(l.middleware(CAS))
+	}
+	acChain, casChain = acChain.Append(o.middleware...), casChain.Append(o.middleware...)
+
+	var comp *compressor
+	if o.compress != nil {
+		comp = newCompressor(*o.compress)
+	}
 	mux := http.NewServeMux()
-	mux.Handle("/ac/", chain.Then(&handler{Cache: cache, store: AC}))
-	mux.Handle("/cas/", chain.Then(&handler{Cache: cache, store: CAS}))
+	mux.Handle("/ac/", acChain.Then(&handler{Cache: cache, store: AC, adminToken: o.adminToken, stats: o.stats, maxSize: o.maxSize[AC], compress: comp}))
+	mux.Handle("/cas/", casChain.Then(&handler{Cache: cache, store: CAS, adminToken: o.adminToken, stats: o.stats, maxSize: o.maxSize[CAS], compress: comp}))
+	if o.adminToken != nil {
+		// the admin API's reports are JSON, which always compresses well
+		admin := chain.Append(gziphandler.GzipHandler)
+		mux.Handle("/admin/purge", admin.Then(requireToken(o.adminToken, &purgeHandler{cache})))
+		mux.Handle("/admin/list", admin.Then(requireToken(o.adminToken, &listHandler{cache})))
+		if o.stats != nil {
+			mux.Handle("/admin/stats", admin.Then(requireToken(o.adminToken, &statsHandler{o.stats})))
+		}
+	}
 
 	if checker, ok := cache.(health.Checker); ok {
-		mux.Handle("/healthz", health.Handler(health.WithChecker("cache", checker)))
-	} else {
-		mux.Handle("/healthz", health.Handler())
+		o.readyChecks["cache"] = checker
 	}
+	ready := &healthHandler{checks: o.readyChecks}
+	mux.Handle("/livez", &healthHandler{})
+	mux.Handle("/readyz", ready)
+	// kept for clients from before the split
+	mux.Handle("/healthz", ready)
 
 	return &http.Server{Addr: addr, Handler: mux}
 }
 
+// Shutdown stops s gracefully. It fails readiness through drain and waits for
+// period so that traffic moves elsewhere, waits for in-flight requests to
+// finish and then for c to finish any writes it makes in the background. It
+// gives up once ctx is done.
+func Shutdown(ctx context.Context, s *http.Server, c Cache, drain *Drain, period time.Duration) error {
+	log := zerolog.Ctx(ctx)
+	if drain != nil {
+		drain.Start()
+	}
+	if period > 0 {
+		log.Info().Dur("period", period).Msg("draining")
+		timer := time.NewTimer(period)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if err := s.Shutdown(ctx); err != nil {
+		return err
+	}
+	log.Info().Msg("flushing pending writes")
+	return Flush(ctx, c)
+}
+
 type handler struct {
 	Cache
-	store Store
+	store      Store
+	adminToken *Token
+	stats      *Stats
+	// maxSize limits the size of uploads, unless it's zero
+	maxSize int64
+	skipped int64
+	// compress compresses entries, unless it's nil
+	compress *compressor
 }
 
 var _ http.Handler = &handler{}
@@ -70,6 +203,12 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.get(w, r)
 	case http.MethodPut:
 		h.put(w, r)
+	case http.MethodDelete:
+		if h.adminToken.Get() == "" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		} else {
+			requireToken(h.adminToken, http.HandlerFunc(h.delete)).ServeHTTP(w, r)
+		}
 	default:
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
@@ -78,7 +217,10 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 var sha256 = regexp.MustCompile("^[a-f0-9]{64}$")
 
 func keyFromRequest(r *http.Request) (Key, error) {
-	p := path.Base(r.URL.Path)
+	return keyFromDigest(path.Base(r.URL.Path))
+}
+
+func keyFromDigest(p string) (Key, error) {
 	if !sha256.Match([]byte(p)) {
 		return "", ErrNotFound
 	}
@@ -86,12 +228,110 @@ func keyFromRequest(r *http.Request) (Key, error) {
 	return Key(p), nil
 }
 
-func handleHttpError(w http.ResponseWriter, r *http.Request, err error) {
+// parseRange parses a Range header into an offset and length as understood by
+// RangeReader. Only a single byte range is supported; anything else is
+// reported as not ok and the whole entry should be served instead.
+func parseRange(header string) (int64, int64, bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, false
+	}
+	spec := strings.TrimSpace(header[len(prefix):])
+	if strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return 0, 0, false
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return -n, -1, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end - start + 1, true
+}
+
+// etag returns the entity tag for an entry. CAS keys are the digest of their
+// content so they make a strong validator; AC entries can be overwritten and
+// have none.
+func (h *handler) etag(key Key) string {
+	if h.store != CAS {
+		return ""
+	}
+	return `"` + path.Base(string(key)) + `"`
+}
+
+// etagMatch reports whether an If-None-Match header matches etag. The
+// comparison is weak, as If-None-Match requires.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// record counts a read as a hit or, if it wasn't found, a miss. Other errors
+// aren't counted.
+func (h *handler) record(err error) {
+	if h.stats == nil {
+		return
+	}
+	if err == nil {
+		h.stats.Record(h.store, true)
+	} else if errors.Is(err, ErrNotFound) {
+		h.stats.Record(h.store, false)
+	}
+}
+
+// errorStatus is the status of a response to a request that failed with err.
+func errorStatus(err error) int {
 	if errors.Is(err, ErrNotFound) {
-		w.WriteHeader(http.StatusNotFound)
-	} else {
+		return http.StatusNotFound
+	} else if errors.Is(err, ErrInvalidRange) {
+		return http.StatusRequestedRangeNotSatisfiable
+	} else if errors.Is(err, ErrNotSupported) {
+		return http.StatusNotImplemented
+	} else if errors.Is(err, ErrBreakerOpen) {
+		return http.StatusServiceUnavailable
+	} else if errors.Is(err, errQuotaExceeded) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+func handleHttpError(w http.ResponseWriter, r *http.Request, err error) {
+	var quota *quotaError
+	if errors.As(err, &quota) {
+		w.Header().Set("Retry-After", retryAfter(quota.wait))
+	}
+	switch status := errorStatus(err); status {
+	case http.StatusNotFound:
+		w.WriteHeader(status)
+	case http.StatusInternalServerError:
 		hlog.FromRequest(r).Err(err).Send()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), status)
+	default:
+		http.Error(w, err.Error(), status)
 	}
 }
 
@@ -102,10 +342,25 @@ func (h *handler) head(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.Exists(r.Context(), h.store, key); err != nil {
+	info, err := h.Stat(r.Context(), h.store, key)
+	h.record(err)
+	if err != nil {
 		handleHttpError(w, r, err)
 		return
 	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Content-Type", "application/octect-stream")
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if etag := h.etag(key); etag != "" {
+		w.Header().Set("ETag", etag)
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+		}
+	}
 }
 
 func (h *handler) get(w http.ResponseWriter, r *http.Request) {
@@ -115,7 +370,28 @@ func (h *handler) get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag := h.etag(key)
+	if etag != "" && etagMatch(r.Header.Get("If-None-Match"), etag) {
+		err := h.Exists(r.Context(), h.store, key)
+		h.record(err)
+		if err != nil {
+			handleHttpError(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if offset, length, ok := parseRange(r.Header.Get("Range")); ok {
+		if ifRange := r.Header.Get("If-Range"); ifRange == "" || ifRange == etag {
+			h.getRange(w, r, key, offset, length)
+			return
+		}
+	}
+
 	reader, size, err := h.Reader(r.Context(), h.store, key)
+	h.record(err)
 	if err != nil {
 		handleHttpError(w, r, err)
 		return
@@ -124,13 +400,78 @@ func (h *handler) get(w http.ResponseWriter, r *http.Request) {
 		defer closer.Close()
 	}
 
-	w.Header().Add("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Add("Accept-Ranges", "bytes")
 	w.Header().Add("Content-Type", "application/octect-stream")
+	if h.compress != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if enc := h.compress.negotiate(r.Header.Get("Accept-Encoding")); enc != "" && h.compress.eligible(size) {
+			compressed, rest, release, err := h.compress.compress(h.store, key, reader, size, enc)
+			if err != nil {
+				handleHttpError(w, r, err)
+				return
+			}
+			defer release()
+			if compressed != nil {
+				// the compressed entry is equivalent to, but not the same
+				// bytes as, the entry itself
+				if etag != "" {
+					w.Header().Set("ETag", "W/"+etag)
+				}
+				w.Header().Set("Content-Encoding", enc)
+				w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+				w.Write(compressed)
+				return
+			}
+			reader = rest
+		}
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Add("Content-Length", strconv.FormatInt(size, 10))
 	if size == 0 {
 		w.WriteHeader(http.StatusOK)
 	} else {
-		io.Copy(w, io.LimitReader(reader, size))
+		sendContent(w, reader, size)
+	}
+}
+
+func (h *handler) getRange(w http.ResponseWriter, r *http.Request, key Key, offset, length int64) {
+	reader, size, err := ReadRange(r.Context(), h.Cache, h.store, key, offset, length)
+	h.record(err)
+	if errors.Is(err, ErrInvalidRange) && size >= 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	}
+	if err != nil {
+		handleHttpError(w, r, err)
+		return
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	start, length, _ := ResolveRange(offset, length, size)
+	if etag := h.etag(key); etag != "" {
+		w.Header().Set("ETag", etag)
 	}
+	w.Header().Add("Accept-Ranges", "bytes")
+	w.Header().Add("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Add("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	w.Header().Add("Content-Type", "application/octect-stream")
+	w.WriteHeader(http.StatusPartialContent)
+	sendContent(w, reader, length)
+}
+
+// sendContent copies n bytes of reader to w. Entries read from disk reach
+// net/http as a file, possibly limited to a range, which it sends with
+// sendfile rather than copying through user space.
+func sendContent(w io.Writer, reader io.Reader, n int64) (int64, error) {
+	reader = unwrapReader(reader)
+	if limited, ok := reader.(*io.LimitedReader); !ok || limited.N > n {
+		reader = io.LimitReader(reader, n)
+	}
+	return io.Copy(w, reader)
 }
 
 func (h *handler) put(w http.ResponseWriter, r *http.Request) {
@@ -140,24 +481,101 @@ func (h *handler) put(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	max := h.maxSize
+	if max > 0 && r.ContentLength > max {
+		tooLarge(w, r, h.store, key, r.ContentLength)
+		return
+	}
+
+	// CAS keys are the digest of their content so there's nothing to gain
+	// from uploading a blob that's already there. Only peek, since the blob
+	// isn't about to be read.
+	if h.store == CAS {
+		if _, err := h.Stat(peek(r.Context()), h.store, key); err == nil {
+			drained, _ := io.Copy(io.Discard, r.Body)
+			hlog.FromRequest(r).Info().
+				Stringer("store", h.store).
+				Stringer("key", key).
+				Int64("size", drained).
+				Int64("skipped", atomic.AddInt64(&h.skipped, 1)).
+				Msg("upload skipped")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
 	writer, err := h.Writer(r.Context(), h.store, key)
 	if err != nil && !errors.Is(err, ErrNotFound) {
 		handleHttpError(w, r, err)
 		return
 	}
-	if closer, ok := writer.(io.Closer); ok {
-		defer closer.Close()
+
+	// chunked uploads don't say how large they are, so read one byte past
+	// the maximum to tell whether they're too large
+	body := io.Reader(r.Body)
+	if r.ContentLength >= 0 {
+		body = io.LimitReader(r.Body, r.ContentLength)
+	} else if max > 0 {
+		body = io.LimitReader(r.Body, max+1)
 	}
 
-	if written, err := io.Copy(writer, io.LimitReader(r.Body, r.ContentLength)); err != nil {
+	written, err := io.Copy(writer, body)
+	switch {
+	case err != nil:
+		Abort(writer)
 		handleHttpError(w, r, err)
 		return
-	} else {
-		hlog.FromRequest(r).Debug().Caller().
-			Stringer("store", h.store).
-			Stringer("key", key).
-			Int64("size", written).
-			Send()
+	case max > 0 && written > max:
+		Abort(writer)
+		tooLarge(w, r, h.store, key, written)
+		return
+	case r.ContentLength >= 0 && written < r.ContentLength:
+		Abort(writer)
+		http.Error(w, "incomplete upload", http.StatusBadRequest)
+		return
+	case r.Context().Err() != nil:
+		// the client went away, so whatever was written may be partial
+		Abort(writer)
+		return
 	}
+	if closer, ok := writer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			handleHttpError(w, r, err)
+			return
+		}
+	}
+
+	hlog.FromRequest(r).Debug().Caller().
+		Stringer("store", h.store).
+		Stringer("key", key).
+		Int64("size", written).
+		Send()
 	w.WriteHeader(http.StatusOK)
 }
+
+func tooLarge(w http.ResponseWriter, r *http.Request, store Store, key Key, size int64) {
+	hlog.FromRequest(r).Info().
+		Stringer("store", store).
+		Stringer("key", key).
+		Int64("size", size).
+		Msg("upload too large")
+	http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+}
+
+func (h *handler) delete(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromRequest(r)
+	if err != nil {
+		handleHttpError(w, r, err)
+		return
+	}
+
+	if err := Delete(withUpstreamDelete(r.Context()), h.Cache, h.store, key); err != nil {
+		handleHttpError(w, r, err)
+		return
+	}
+	hlog.FromRequest(r).Info().
+		Stringer("store", h.store).
+		Stringer("key", key).
+		Msg("deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
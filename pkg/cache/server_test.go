@@ -17,10 +17,18 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -58,3 +66,380 @@ func TestHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestHandlerRange(t *testing.T) {
+	assert := assert.New(t)
+	sha := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	specs := []struct {
+		rng     string
+		ifRange string
+		code    int
+		cr      string
+		resp    []byte
+	}{
+		{"", "", http.StatusOK, "", []byte("foobar")},
+		{"bytes=0-2", "", http.StatusPartialContent, "bytes 0-2/6", []byte("foo")},
+		{"bytes=3-", "", http.StatusPartialContent, "bytes 3-5/6", []byte("bar")},
+		{"bytes=-2", "", http.StatusPartialContent, "bytes 4-5/6", []byte("ar")},
+		{"bytes=4-100", "", http.StatusPartialContent, "bytes 4-5/6", []byte("ar")},
+		{"bytes=6-", "", http.StatusRequestedRangeNotSatisfiable, "bytes */6", nil},
+		{"bytes=0-1,3-4", "", http.StatusOK, "", []byte("foobar")},
+		{"bytes=2-1", "", http.StatusOK, "", []byte("foobar")},
+		{"bytes=0-2", `"` + sha + `"`, http.StatusPartialContent, "bytes 0-2/6", []byte("foo")},
+		{"bytes=0-2", `"stale"`, http.StatusOK, "", []byte("foobar")},
+	}
+
+	for _, c := range []Cache{NewMemCache(), NewLRUCache(NewMemCache(), 1024), NewLRUCache(NewMemCache(), 0)} {
+		h := &handler{Cache: c, store: CAS}
+		req := httptest.NewRequest(http.MethodPut, "/cas/"+sha, bytes.NewReader([]byte("foobar")))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		for _, s := range specs {
+			req := httptest.NewRequest(http.MethodGet, "/cas/"+sha, nil)
+			if s.rng != "" {
+				req.Header.Set("Range", s.rng)
+			}
+			if s.ifRange != "" {
+				req.Header.Set("If-Range", s.ifRange)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			assert.Equal(s.code, resp.StatusCode, s.rng)
+			assert.Equal(s.cr, resp.Header.Get("Content-Range"), s.rng)
+			if s.resp != nil {
+				assert.Equal(s.resp, body, s.rng)
+			}
+		}
+	}
+}
+
+func TestUnwrapReader(t *testing.T) {
+	assert := assert.New(t)
+	file, err := ioutil.TempFile(t.TempDir(), "")
+	assert.NoError(err)
+	defer file.Close()
+
+	cancelled := false
+	reader := io.Reader(cancelReader{file, func() { cancelled = true }})
+	assert.Equal(file, unwrapReader(reader))
+
+	limited, ok := unwrapReader(limitReader(reader, 3)).(*io.LimitedReader)
+	assert.True(ok)
+	assert.Equal(file, limited.R)
+	assert.Equal(int64(3), limited.N)
+	assert.False(cancelled)
+
+	// readers that change what's read aren't unwrapped
+	buf := bytes.NewBufferString("foo")
+	assert.Equal(buf, unwrapReader(buf))
+}
+
+// fileCache serves every entry from one file.
+type fileCache struct {
+	Cache
+	path string
+}
+
+func (c fileCache) Reader(ctx context.Context, store Store, key Key) (io.Reader, int64, error) {
+	file, err := os.Open(c.path)
+	if err != nil {
+		return nil, -1, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, -1, err
+	}
+	return file, info.Size(), nil
+}
+
+func (c fileCache) Stat(ctx context.Context, store Store, key Key) (Info, error) {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// readFromRecorder records what it's asked to read from.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	src io.Reader
+}
+
+func (w *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.src = src
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestHandlerSendfile(t *testing.T) {
+	assert := assert.New(t)
+	sha := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	path := filepath.Join(t.TempDir(), sha)
+	assert.NoError(ioutil.WriteFile(path, []byte("foobar"), 0600))
+	// wrapped like the server wraps a disk cache, with an LRU too small to
+	// hold the entry
+	var c Cache = NewStats(fileCache{NewMemCache(), path})
+	c = NewTimeout(c, Timeouts{Read: time.Minute})
+	c = NewLRUCache(c, 1)
+	c = NewTTLCache(c, map[Store]time.Duration{CAS: time.Hour})
+	h := &handler{Cache: c, store: CAS}
+
+	for _, rng := range []string{"", "bytes=3-"} {
+		req := httptest.NewRequest(http.MethodGet, "/cas/"+sha, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		w := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(w, req)
+
+		// net/http sends a file limited this way with sendfile
+		limited, ok := w.src.(*io.LimitedReader)
+		if assert.True(ok, rng) {
+			assert.IsType(&os.File{}, limited.R, rng)
+		}
+	}
+}
+
+func TestHandlerConditional(t *testing.T) {
+	assert := assert.New(t)
+	sha := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	etag := `"` + sha + `"`
+	specs := []struct {
+		method      string
+		ifNoneMatch string
+		code        int
+		etag        string
+	}{
+		{http.MethodHead, "", http.StatusOK, etag},
+		{http.MethodHead, etag, http.StatusNotModified, etag},
+		{http.MethodGet, "", http.StatusOK, etag},
+		{http.MethodGet, etag, http.StatusNotModified, etag},
+		{http.MethodGet, `W/"other", ` + etag, http.StatusNotModified, etag},
+		{http.MethodGet, "*", http.StatusNotModified, etag},
+		{http.MethodGet, `"other"`, http.StatusOK, etag},
+	}
+
+	h := &handler{Cache: NewMemCache(), store: CAS}
+	req := httptest.NewRequest(http.MethodPut, "/cas/"+sha, bytes.NewReader([]byte("foobar")))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, s := range specs {
+		req := httptest.NewRequest(s.method, "/cas/"+sha, nil)
+		if s.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", s.ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		resp := w.Result()
+		assert.Equal(s.code, resp.StatusCode, s.ifNoneMatch)
+		assert.Equal(s.etag, resp.Header.Get("ETag"), s.ifNoneMatch)
+	}
+
+	// re-uploading an existing blob is skipped without touching its content
+	req = httptest.NewRequest(http.MethodPut, "/cas/"+sha, bytes.NewReader([]byte("bazqux")))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Result().StatusCode)
+	assert.Equal(int64(1), h.skipped)
+
+	req = httptest.NewRequest(http.MethodGet, "/cas/"+sha, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	assert.Equal([]byte("foobar"), body)
+
+	// AC entries can change so they never get an ETag
+	h = &handler{Cache: NewMemCache(), store: AC}
+	req = httptest.NewRequest(http.MethodPut, "/ac/"+sha, bytes.NewReader([]byte("foobar")))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodGet, "/ac/"+sha, nil)
+	req.Header.Set("If-None-Match", "*")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Result().StatusCode)
+	assert.Empty(w.Result().Header.Get("ETag"))
+}
+
+func TestHandlerHead(t *testing.T) {
+	assert := assert.New(t)
+	sha := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+	for _, c := range []Cache{NewMemCache(), NewLRUCache(NewMemCache(), 1024)} {
+		h := &handler{Cache: c, store: AC}
+		req := httptest.NewRequest(http.MethodPut, "/ac/"+sha, bytes.NewReader([]byte("foobar")))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		req = httptest.NewRequest(http.MethodHead, "/ac/"+sha, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		resp := w.Result()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.Equal("6", resp.Header.Get("Content-Length"))
+		modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+		assert.NoError(err)
+		assert.WithinDuration(time.Now(), modTime, time.Minute)
+	}
+}
+
+// slowCache writes to a MemCache slowly, and in the background once the
+// writer is closed if async is set.
+type slowCache struct {
+	*MemCache
+	delay   time.Duration
+	async   bool
+	started chan struct{}
+	pending sync.WaitGroup
+}
+
+type slowWriter struct {
+	*slowCache
+	ctx   context.Context
+	store Store
+	key   Key
+	buf   bytes.Buffer
+}
+
+func (c *slowCache) Writer(ctx context.Context, store Store, key Key) (io.Writer, error) {
+	close(c.started)
+	return &slowWriter{slowCache: c, ctx: ctx, store: store, key: key}, nil
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	if !w.async {
+		time.Sleep(w.delay)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *slowWriter) Close() error {
+	write := func() {
+		mw, _ := w.MemCache.Writer(w.ctx, w.store, w.key)
+		mw.Write(w.buf.Bytes())
+		mw.(io.Closer).Close()
+	}
+	if !w.async {
+		write()
+		return nil
+	}
+	w.pending.Add(1)
+	go func() {
+		defer w.pending.Done()
+		time.Sleep(w.delay)
+		write()
+	}()
+	return nil
+}
+
+func (c *slowCache) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	const sha = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	specs := []struct {
+		name    string
+		async   bool
+		timeout time.Duration
+		err     error
+	}{
+		{"in-flight request", false, time.Second, nil},
+		{"pending write", true, time.Second, nil},
+		{"deadline", false, 10 * time.Millisecond, context.DeadlineExceeded},
+		{"pending write deadline", true, 10 * time.Millisecond, context.DeadlineExceeded},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.name, func(t *testing.T) {
+			assert := assert.New(t)
+			c := &slowCache{MemCache: NewMemCache(), delay: 100 * time.Millisecond, async: spec.async, started: make(chan struct{})}
+			drain := &Drain{}
+			s := NewServer("", c, WithReadyCheck("drain", drain))
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NoError(err)
+			go s.Serve(l)
+
+			codes := make(chan int, 1)
+			go func() {
+				req, _ := http.NewRequest(http.MethodPut, "http://"+l.Addr().String()+"/cas/"+sha, strings.NewReader("foo"))
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					codes <- 0
+					return
+				}
+				resp.Body.Close()
+				codes <- resp.StatusCode
+			}()
+			<-c.started
+
+			ctx, cancel := context.WithTimeout(context.Background(), spec.timeout)
+			defer cancel()
+			err = Shutdown(ctx, s, c, drain, 0)
+			assert.ErrorIs(err, spec.err)
+			assert.ErrorIs(drain.Check(ctx), ErrDraining)
+			if spec.err != nil {
+				s.Close()
+				return
+			}
+
+			assert.Equal(http.StatusOK, <-codes)
+			key, _ := keyFromDigest(sha)
+			assert.NoError(c.MemCache.Exists(ctx, CAS, key))
+		})
+	}
+}
+
+func TestHandlerPutSize(t *testing.T) {
+	assert := assert.New(t)
+	const sha = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	key, _ := keyFromDigest(sha)
+	specs := []struct {
+		body    string
+		chunked bool
+		code    int
+	}{
+		{"0123456789", false, http.StatusOK},
+		{"0123456789", true, http.StatusOK},
+		{"0123456789a", false, http.StatusRequestEntityTooLarge},
+		{"0123456789a", true, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, spec := range specs {
+		c := NewMemCache()
+		h := &handler{Cache: c, store: AC, maxSize: 10}
+		req := httptest.NewRequest(http.MethodPut, "/ac/"+sha, strings.NewReader(spec.body))
+		if spec.chunked {
+			// hide the length as a chunked upload would
+			req.Body = ioutil.NopCloser(struct{ io.Reader }{req.Body})
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(spec.code, w.Result().StatusCode, spec)
+
+		reader, _, err := c.Reader(context.Background(), AC, key)
+		if spec.code == http.StatusOK {
+			assert.NoError(err)
+			data, _ := ioutil.ReadAll(reader)
+			assert.Equal(spec.body, string(data))
+		} else {
+			assert.ErrorIs(err, ErrNotFound)
+		}
+	}
+}
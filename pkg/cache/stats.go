@@ -0,0 +1,411 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	health "github.com/etherlabsio/healthcheck/v2"
+)
+
+const (
+	// largestBlobs is how many of the largest CAS blobs Stats reports, out
+	// of the largestCandidates it keeps track of so that blobs removed from
+	// the top can be replaced.
+	largestBlobs      = 10
+	largestCandidates = 10 * largestBlobs
+	// hitWindow is how far back the windowed hit ratios look, kept as hourly
+	// buckets.
+	hitWindow = 7 * 24 * time.Hour
+)
+
+// Stats keeps running totals of the entries in the cache it wraps. It should
+// wrap the backend directly so that it sees every write and delete, including
+// those made by expiry and garbage collection. The totals start from a single
+// walk of each store made by Seed, and are only approximate for writes made
+// while that walk is running. Without it they're unknown, since removals of
+// entries that were never counted would drive them negative.
+//
+// Hits and misses are recorded by the server with Record since only it knows
+// which reads were asked for by clients.
+type Stats struct {
+	cache   Cache
+	lock    sync.Mutex
+	stores  map[Store]*storeStats
+	largest []Blob
+	lru     *LRU
+	// counting is set once Seed starts, and seeded once it's done
+	counting bool
+	seeded   bool
+}
+
+type storeStats struct {
+	entries int64
+	bytes   int64
+	hits    int64
+	misses  int64
+	buckets [hitWindow / time.Hour]hitBucket
+}
+
+type hitBucket struct {
+	hour   time.Time
+	hits   int64
+	misses int64
+}
+
+var _ Cache = &Stats{}
+
+func NewStats(cache Cache) *Stats {
+	return &Stats{cache: cache, stores: map[Store]*storeStats{AC: {}, CAS: {}}}
+}
+
+// SetLRU includes the occupancy of lru in reports.
+func (s *Stats) SetLRU(lru *LRU) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lru = lru
+}
+
+// Seed counts the entries already in the cache. Until it finishes the totals
+// are reported as unknown. It walks the whole cache, which takes a while and
+// costs requests on remote caches, so it's only done when asked for.
+func (s *Stats) Seed(ctx context.Context) error {
+	s.lock.Lock()
+	s.counting = true
+	s.lock.Unlock()
+
+	for store := range s.stores {
+		var entries, bytes int64
+		var largest []Blob
+		if err := Walk(ctx, s.cache, store, func(key Key, info Info) error {
+			entries++
+			bytes += info.Size
+			if store == CAS {
+				largest = insertLargest(largest, Blob{Key: path.Base(string(key)), Size: info.Size})
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		s.lock.Lock()
+		st := s.stores[store]
+		st.entries += entries
+		st.bytes += bytes
+		for _, blob := range largest {
+			s.largest = insertLargest(s.largest, blob)
+		}
+		s.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	s.seeded = true
+	s.lock.Unlock()
+	return nil
+}
+
+// insertLargest adds blob to a list of the largest blobs sorted by descending
+// size, replacing any earlier size for the same blob.
+func insertLargest(largest []Blob, blob Blob) []Blob {
+	largest = removeLargest(largest, blob.Key)
+	i := sort.Search(len(largest), func(i int) bool { return largest[i].Size < blob.Size })
+	if i >= largestCandidates {
+		return largest
+	}
+	largest = append(largest, Blob{})
+	copy(largest[i+1:], largest[i:])
+	largest[i] = blob
+	if len(largest) > largestCandidates {
+		largest = largest[:largestCandidates]
+	}
+	return largest
+}
+
+func removeLargest(largest []Blob, digest string) []Blob {
+	for i, blob := range largest {
+		if blob.Key == digest {
+			return append(largest[:i], largest[i+1:]...)
+		}
+	}
+	return largest
+}
+
+// Record counts a client read of store as a hit or a miss.
+func (s *Stats) Record(store Store, hit bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.stores[store]
+	if !ok {
+		return
+	}
+	hour := time.Now().Truncate(time.Hour)
+	b := &st.buckets[hour.Unix()/3600%int64(len(st.buckets))]
+	if !b.hour.Equal(hour) {
+		*b = hitBucket{hour: hour}
+	}
+	if hit {
+		st.hits++
+		b.hits++
+	} else {
+		st.misses++
+		b.misses++
+	}
+}
+
+// added adjusts the totals for an entry that was written with size bytes,
+// replacing an entry of old bytes if old is not negative.
+func (s *Stats) added(store Store, key Key, size, old int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.stores[store]
+	if !ok {
+		return
+	}
+	if s.counting {
+		if old < 0 {
+			st.entries++
+			old = 0
+		}
+		st.bytes += size - old
+	}
+	if store == CAS {
+		s.largest = insertLargest(s.largest, Blob{Key: path.Base(string(key)), Size: size})
+	}
+}
+
+func (s *Stats) removed(store Store, key Key, size int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.stores[store]
+	if !ok {
+		return
+	}
+	if s.counting {
+		st.entries--
+		st.bytes -= size
+	}
+	if store == CAS {
+		// the candidates beyond those reported take the place of the blobs
+		// removed; once they run out the list fills up again from writes
+		s.largest = removeLargest(s.largest, path.Base(string(key)))
+	}
+}
+
+// HitStats counts client reads that found an entry and those that didn't.
+type HitStats struct {
+	Hits   int64   `json:"hits"`
+	Misses int64   `json:"misses"`
+	Ratio  float64 `json:"ratio"`
+}
+
+func newHitStats(hits, misses int64) HitStats {
+	hs := HitStats{Hits: hits, Misses: misses}
+	if total := hits + misses; total > 0 {
+		hs.Ratio = float64(hits) / float64(total)
+	}
+	return hs
+}
+
+// StoreStats describes one store. Entries and Bytes are -1 until the stats are
+// seeded. Total covers reads since the server started and Window those in the
+// last week.
+type StoreStats struct {
+	Entries int64    `json:"entries"`
+	Bytes   int64    `json:"bytes"`
+	Total   HitStats `json:"total"`
+	Window  HitStats `json:"window"`
+}
+
+// LRUStats describes how full the in-memory cache is.
+type LRUStats struct {
+	Size int64 `json:"size"`
+	Max  int64 `json:"max"`
+}
+
+// Blob is a CAS blob identified by its digest.
+type Blob struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// StatsReport is a snapshot of Stats, as served by the admin API.
+type StatsReport struct {
+	Seeded  bool                  `json:"seeded"`
+	Stores  map[Store]*StoreStats `json:"stores"`
+	LRU     *LRUStats             `json:"lru,omitempty"`
+	Largest []Blob                `json:"largest"`
+}
+
+func (s *Stats) Report() StatsReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	since := time.Now().Add(-hitWindow)
+	report := StatsReport{
+		Seeded:  s.seeded,
+		Stores:  make(map[Store]*StoreStats),
+		Largest: append([]Blob{}, s.largest...),
+	}
+	if len(report.Largest) > largestBlobs {
+		report.Largest = report.Largest[:largestBlobs]
+	}
+	for store, st := range s.stores {
+		var hits, misses int64
+		for _, b := range st.buckets {
+			if b.hour.After(since) {
+				hits += b.hits
+				misses += b.misses
+			}
+		}
+		report.Stores[store] = &StoreStats{
+			Entries: -1,
+			Bytes:   -1,
+			Total:   newHitStats(st.hits, st.misses),
+			Window:  newHitStats(hits, misses),
+		}
+		if s.seeded {
+			report.Stores[store].Entries, report.Stores[store].Bytes = st.entries, st.bytes
+		}
+	}
+	if s.lru != nil {
+		report.LRU = &LRUStats{Size: s.lru.Size(), Max: s.lru.Max()}
+	}
+	return report
+}
+
+func (s *Stats) Exists(ctx context.Context, store Store, key Key) error {
+	return s.cache.Exists(ctx, store, key)
+}
+
+func (s *Stats) Stat(ctx context.Context, store Store, key Key) (Info, error) {
+	return s.cache.Stat(ctx, store, key)
+}
+
+func (s *Stats) Reader(ctx context.Context, store Store, key Key) (io.Reader, int64, error) {
+	return s.cache.Reader(ctx, store, key)
+}
+
+var _ RangeReader = &Stats{}
+
+func (s *Stats) RangeReader(ctx context.Context, store Store, key Key, offset, length int64) (io.Reader, int64, error) {
+	return ReadRange(ctx, s.cache, store, key, offset, length)
+}
+
+// Writer counts the bytes written and updates the totals when the writer is
+// closed. Writers that implement Replacer say whether they replaced an entry;
+// those of other caches are counted as new entries.
+func (s *Stats) Writer(ctx context.Context, store Store, key Key) (io.Writer, error) {
+	w, err := s.cache.Writer(ctx, store, key)
+	if err != nil {
+		return w, err
+	}
+	return &statsWriter{Writer: w, stats: s, store: store, key: key}, nil
+}
+
+type statsWriter struct {
+	io.Writer
+	stats   *Stats
+	store   Store
+	key     Key
+	written int64
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *statsWriter) Close() error {
+	if closer, ok := w.Writer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	w.stats.added(w.store, w.key, w.written, Replaced(w.Writer))
+	return nil
+}
+
+var _ Aborter = &statsWriter{}
+
+func (w *statsWriter) Abort() error {
+	return Abort(w.Writer)
+}
+
+var _ Deleter = &Stats{}
+
+func (s *Stats) Delete(ctx context.Context, store Store, key Key) error {
+	info, err := s.cache.Stat(ctx, store, key)
+	if err != nil {
+		return err
+	}
+	if err := Delete(ctx, s.cache, store, key); err != nil {
+		return err
+	}
+	s.removed(store, key, info.Size)
+	return nil
+}
+
+var _ Walker = &Stats{}
+
+func (s *Stats) Walk(ctx context.Context, store Store, fn WalkFunc) error {
+	return Walk(ctx, s.cache, store, fn)
+}
+
+var _ SeekWalker = &Stats{}
+
+func (s *Stats) WalkAfter(ctx context.Context, store Store, after Key, fn WalkFunc) error {
+	return WalkAfter(ctx, s.cache, store, after, fn)
+}
+
+var _ Flusher = &Stats{}
+
+func (s *Stats) Flush(ctx context.Context) error {
+	return Flush(ctx, s.cache)
+}
+
+var _ health.Checker = &Stats{}
+
+func (s *Stats) Check(ctx context.Context) error {
+	if checker, ok := s.cache.(health.Checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+// statsHandler serves the report of a Stats.
+type statsHandler struct {
+	stats *Stats
+}
+
+var _ http.Handler = &statsHandler{}
+
+func (h *statsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, h.stats.Report())
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mem := NewMemCache()
+	fill(mem, CAS)
+
+	stats := NewStats(mem)
+	lru := NewLRUCache(stats, 1024)
+	stats.SetLRU(lru)
+	assert.NoError(stats.Seed(ctx))
+
+	report := stats.Report()
+	assert.True(report.Seeded)
+	assert.Equal(int64(3), report.Stores[CAS].Entries)
+	assert.Equal(int64(3*64), report.Stores[CAS].Bytes)
+	assert.Equal(int64(0), report.Stores[AC].Entries)
+	assert.Len(report.Largest, 3)
+
+	key, _ := keyFromDigest(digests[0])
+	w, _ := lru.Writer(ctx, AC, key)
+	w.Write([]byte("hello"))
+	w.(io.Closer).Close()
+	w, _ = lru.Writer(ctx, AC, key)
+	w.Write([]byte("hello world"))
+	w.(io.Closer).Close()
+
+	w, _ = lru.Writer(ctx, CAS, key)
+	w.Write(make([]byte, 100))
+	w.(io.Closer).Close()
+
+	report = stats.Report()
+	assert.Equal(int64(1), report.Stores[AC].Entries)
+	assert.Equal(int64(11), report.Stores[AC].Bytes)
+	assert.Equal(int64(3), report.Stores[CAS].Entries)
+	assert.Equal(Blob{Key: digests[0], Size: 100}, report.Largest[0])
+	assert.Len(report.Largest, 3)
+
+	assert.NoError(lru.Delete(ctx, CAS, key))
+	report = stats.Report()
+	assert.Equal(int64(2), report.Stores[CAS].Entries)
+	assert.Equal(int64(2*64), report.Stores[CAS].Bytes)
+	assert.Len(report.Largest, 2)
+
+	lru.Reader(ctx, AC, key)
+	report = stats.Report()
+	assert.Equal(&LRUStats{Size: 11, Max: 1024}, report.LRU)
+}
+
+// statCountingCache counts the calls made to Stat.
+type statCountingCache struct {
+	Cache
+	stats int32
+}
+
+func (c *statCountingCache) Stat(ctx context.Context, store Store, key Key) (Info, error) {
+	atomic.AddInt32(&c.stats, 1)
+	return c.Cache.Stat(ctx, store, key)
+}
+
+func (c *statCountingCache) Delete(ctx context.Context, store Store, key Key) error {
+	return Delete(ctx, c.Cache, store, key)
+}
+
+func (c *statCountingCache) Walk(ctx context.Context, store Store, fn WalkFunc) error {
+	return Walk(ctx, c.Cache, store, fn)
+}
+
+func TestStatsLargest(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	counting := &statCountingCache{Cache: NewMemCache()}
+	stats := NewStats(counting)
+	assert.NoError(stats.Seed(ctx))
+
+	var keys []Key
+	for i := 0; i < largestCandidates+5; i++ {
+		key := Key(fmt.Sprintf("%02x/%064x", i%256, i))
+		keys = append(keys, key)
+		w, _ := stats.Writer(ctx, CAS, key)
+		w.Write(make([]byte, i+1))
+		w.(io.Closer).Close()
+	}
+	// writes don't look up what they replace
+	assert.Equal(int32(0), atomic.LoadInt32(&counting.stats))
+	assert.Equal(int64(largestCandidates+5), stats.Report().Stores[CAS].Entries)
+
+	// removing the largest blobs backfills the report
+	for _, key := range keys[len(keys)-largestBlobs:] {
+		assert.NoError(stats.Delete(ctx, CAS, key))
+	}
+	report := stats.Report()
+	if assert.Len(report.Largest, largestBlobs) {
+		assert.Equal(int64(largestCandidates+5-largestBlobs), report.Largest[0].Size)
+	}
+
+	// until the candidates run out
+	for _, key := range keys[largestBlobs : len(keys)-largestBlobs] {
+		assert.NoError(stats.Delete(ctx, CAS, key))
+	}
+	report = stats.Report()
+	if assert.Len(report.Largest, 5) {
+		assert.Equal(int64(largestBlobs), report.Largest[0].Size)
+	}
+}
+
+func TestStatsUnseeded(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mem := NewMemCache()
+	fill(mem, CAS)
+	stats := NewStats(mem)
+
+	// removing entries that were never counted doesn't make the totals
+	// negative, they're unknown until seeded
+	key, _ := keyFromDigest(digests[0])
+	assert.NoError(stats.Delete(ctx, CAS, key))
+	report := stats.Report()
+	assert.False(report.Seeded)
+	assert.Equal(int64(-1), report.Stores[CAS].Entries)
+	assert.Equal(int64(-1), report.Stores[CAS].Bytes)
+
+	assert.NoError(stats.Seed(ctx))
+	assert.Equal(int64(2), stats.Report().Stores[CAS].Entries)
+}
+
+func TestStatsRecord(t *testing.T) {
+	assert := assert.New(t)
+	stats := NewStats(NewMemCache())
+	fill(stats, CAS)
+
+	h := &handler{Cache: stats, store: CAS, stats: stats}
+	for _, digest := range []string{digests[0], digests[1], digests[2], "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"} {
+		req := httptest.NewRequest(http.MethodGet, "/cas/"+digest, nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	report := stats.Report()
+	assert.Equal(HitStats{Hits: 3, Misses: 1, Ratio: 0.75}, report.Stores[CAS].Total)
+	assert.Equal(report.Stores[CAS].Total, report.Stores[CAS].Window)
+	assert.Equal(HitStats{}, report.Stores[AC].Total)
+}
@@ -0,0 +1,292 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	health "github.com/etherlabsio/healthcheck/v2"
+	"github.com/rs/zerolog"
+)
+
+// Tiered fronts a slower upstream cache with a local one. Reads that miss the
+// local cache are served from the upstream and fill the local cache as they
+// go, and writes go to both. Everything else, deletes and walks included,
+// only touches the local cache, so that gc and the janitor leave the upstream
+// alone. Deletes asked for by clients, through the server or the admin API,
+// are the exception: they're passed on to the upstream too, or the entry
+// would just be read back from it.
+type Tiered struct {
+	local    Cache
+	upstream Cache
+}
+
+var _ Cache = &Tiered{}
+
+func NewTieredCache(local, upstream Cache) *Tiered {
+	return &Tiered{local: local, upstream: upstream}
+}
+
+func (c *Tiered) Exists(ctx context.Context, store Store, key Key) error {
+	if err := c.local.Exists(ctx, store, key); !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return c.upstream.Exists(ctx, store, key)
+}
+
+func (c *Tiered) Stat(ctx context.Context, store Store, key Key) (Info, error) {
+	if info, err := c.local.Stat(ctx, store, key); !errors.Is(err, ErrNotFound) {
+		return info, err
+	}
+	return c.upstream.Stat(ctx, store, key)
+}
+
+func (c *Tiered) Reader(ctx context.Context, store Store, key Key) (io.Reader, int64, error) {
+	if reader, size, err := c.local.Reader(ctx, store, key); !errors.Is(err, ErrNotFound) {
+		return reader, size, err
+	}
+
+	reader, size, err := c.upstream.Reader(ctx, store, key)
+	if err != nil {
+		return nil, -1, err
+	}
+	log := zerolog.Ctx(ctx).With().
+		Stringer("store", store).
+		Stringer("key", key).
+		Logger()
+	log.Debug().Caller().Msg("upstream hit")
+
+	w, err := c.local.Writer(ctx, store, key)
+	if err != nil {
+		log.Warn().Err(err).Msg("tier fill")
+		return reader, size, nil
+	}
+	return &fillReader{Reader: reader, w: w, size: size, log: log}, size, nil
+}
+
+// fillReader copies what's read into a local writer, which is only closed if
+// the whole entry was read.
+type fillReader struct {
+	io.Reader
+	w    io.Writer
+	size int64
+	n    int64
+	log  zerolog.Logger
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.w != nil {
+		if _, werr := r.w.Write(p[:n]); werr != nil {
+			r.log.Warn().Err(werr).Msg("tier fill")
+			r.abort()
+		}
+		r.n += int64(n)
+	}
+	if err == io.EOF && r.w != nil {
+		if r.size >= 0 && r.n != r.size {
+			r.abort()
+		} else if closer, ok := r.w.(io.Closer); ok {
+			if cerr := closer.Close(); cerr != nil {
+				r.log.Warn().Err(cerr).Msg("tier fill")
+			}
+			r.w = nil
+		} else {
+			r.w = nil
+		}
+	} else if err != nil {
+		r.abort()
+	}
+	return n, err
+}
+
+func (r *fillReader) abort() {
+	if r.w != nil {
+		Abort(r.w)
+		r.w = nil
+	}
+}
+
+// Close gives up on filling the local cache if the entry wasn't read to the
+// end.
+func (r *fillReader) Close() error {
+	r.abort()
+	if closer, ok := r.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+var _ RangeReader = &Tiered{}
+
+// RangeReader serves misses straight from the upstream without filling the
+// local cache.
+func (c *Tiered) RangeReader(ctx context.Context, store Store, key Key, offset, length int64) (io.Reader, int64, error) {
+	if reader, size, err := ReadRange(ctx, c.local, store, key, offset, length); !errors.Is(err, ErrNotFound) {
+		return reader, size, err
+	}
+	return ReadRange(ctx, c.upstream, store, key, offset, length)
+}
+
+// Writer writes to the local cache and the upstream at once. The write only
+// fails if the local cache fails; an upstream failure is logged and the entry
+// is kept locally.
+func (c *Tiered) Writer(ctx context.Context, store Store, key Key) (io.Writer, error) {
+	local, err := c.local.Writer(ctx, store, key)
+	if err != nil {
+		return nil, err
+	}
+	log := zerolog.Ctx(ctx).With().
+		Stringer("store", store).
+		Stringer("key", key).
+		Logger()
+	upstream, err := c.upstream.Writer(ctx, store, key)
+	if err != nil {
+		log.Warn().Err(err).Msg("upstream write")
+		return local, nil
+	}
+	return &tierWriter{local: local, upstream: upstream, log: log}, nil
+}
+
+type tierWriter struct {
+	local    io.Writer
+	upstream io.Writer
+	log      zerolog.Logger
+}
+
+func (w *tierWriter) Write(p []byte) (int, error) {
+	n, err := w.local.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if w.upstream != nil {
+		if _, err := w.upstream.Write(p); err != nil {
+			w.log.Warn().Err(err).Msg("upstream write")
+			Abort(w.upstream)
+			w.upstream = nil
+		}
+	}
+	return n, nil
+}
+
+// Close commits the local write first, so that the upstream is never given an
+// entry the local cache failed to keep.
+func (w *tierWriter) Close() error {
+	if closer, ok := w.local.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			if w.upstream != nil {
+				Abort(w.upstream)
+			}
+			return err
+		}
+	}
+	if w.upstream != nil {
+		if closer, ok := w.upstream.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				w.log.Warn().Err(err).Msg("upstream write")
+			}
+		}
+	}
+	return nil
+}
+
+var _ Replacer = &tierWriter{}
+
+// Replaced reports what the write replaced locally.
+func (w *tierWriter) Replaced() int64 {
+	return Replaced(w.local)
+}
+
+var _ Aborter = &tierWriter{}
+
+func (w *tierWriter) Abort() error {
+	if w.upstream != nil {
+		Abort(w.upstream)
+	}
+	return Abort(w.local)
+}
+
+var _ Deleter = &Tiered{}
+
+type upstreamDeleteKey struct{}
+
+// withUpstreamDelete marks ctx as belonging to a delete asked for by a client,
+// which Tiered passes on to its upstream.
+func withUpstreamDelete(ctx context.Context) context.Context {
+	return context.WithValue(ctx, upstreamDeleteKey{}, true)
+}
+
+// Delete deletes from the local cache, and from the upstream as well when a
+// client asked for it. It only reports ErrNotFound if neither had the entry.
+func (c *Tiered) Delete(ctx context.Context, store Store, key Key) error {
+	err := Delete(ctx, c.local, store, key)
+	if upstream, _ := ctx.Value(upstreamDeleteKey{}).(bool); !upstream {
+		return err
+	} else if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	uerr := Delete(ctx, c.upstream, store, key)
+	switch {
+	case uerr == nil:
+		return nil
+	case errors.Is(uerr, ErrNotSupported):
+		zerolog.Ctx(ctx).Warn().
+			Stringer("store", store).
+			Stringer("key", key).
+			Msg("upstream can't delete, entry kept")
+		return err
+	case errors.Is(uerr, ErrNotFound):
+		return err
+	default:
+		return uerr
+	}
+}
+
+var _ Walker = &Tiered{}
+
+func (c *Tiered) Walk(ctx context.Context, store Store, fn WalkFunc) error {
+	return Walk(ctx, c.local, store, fn)
+}
+
+var _ SeekWalker = &Tiered{}
+
+func (c *Tiered) WalkAfter(ctx context.Context, store Store, after Key, fn WalkFunc) error {
+	return WalkAfter(ctx, c.local, store, after, fn)
+}
+
+var _ Flusher = &Tiered{}
+
+func (c *Tiered) Flush(ctx context.Context) error {
+	err := Flush(ctx, c.local)
+	if uerr := Flush(ctx, c.upstream); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+var _ health.Checker = &Tiered{}
+
+// Check only checks the local cache, which can keep serving hits while the
+// upstream is down.
+func (c *Tiered) Check(ctx context.Context) error {
+	if checker, ok := c.local.(health.Checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
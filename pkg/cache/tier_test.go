@@ -0,0 +1,86 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTiered(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	local, upstream := NewMemCache(), NewMemCache()
+	c := NewTieredCache(local, upstream)
+
+	write := func(c Cache, key Key, data string) {
+		w, _ := c.Writer(ctx, CAS, key)
+		w.Write([]byte(data))
+		w.(io.Closer).Close()
+	}
+	read := func(key Key) string {
+		r, _, err := c.Reader(ctx, CAS, key)
+		if !assert.NoError(err) {
+			return ""
+		}
+		b, _ := ioutil.ReadAll(r)
+		r.(io.Closer).Close()
+		return string(b)
+	}
+
+	// writes go to both tiers
+	write(c, "a", "foo")
+	assert.NoError(local.Exists(ctx, CAS, "a"))
+	assert.NoError(upstream.Exists(ctx, CAS, "a"))
+
+	// upstream hits fill the local cache once read in full
+	write(upstream, "b", "bar")
+	assert.NoError(c.Exists(ctx, CAS, "b"))
+	assert.True(errors.Is(local.Exists(ctx, CAS, "b"), ErrNotFound))
+	assert.Equal("bar", read("b"))
+	assert.NoError(local.Exists(ctx, CAS, "b"))
+
+	write(upstream, "c", "baz")
+	r, _, err := c.Reader(ctx, CAS, "c")
+	if assert.NoError(err) {
+		r.Read(make([]byte, 1))
+		r.(io.Closer).Close()
+	}
+	assert.True(errors.Is(local.Exists(ctx, CAS, "c"), ErrNotFound))
+
+	// deletes and walks only touch the local cache
+	assert.NoError(c.Delete(ctx, CAS, "a"))
+	assert.NoError(upstream.Exists(ctx, CAS, "a"))
+	var keys []Key
+	c.Walk(ctx, CAS, func(key Key, info Info) error {
+		keys = append(keys, key)
+		return nil
+	})
+	assert.Equal([]Key{"b"}, keys)
+
+	// unless a client asked for the delete
+	assert.NoError(c.Delete(withUpstreamDelete(ctx), CAS, "a"))
+	assert.True(errors.Is(upstream.Exists(ctx, CAS, "a"), ErrNotFound))
+	assert.True(errors.Is(c.Delete(withUpstreamDelete(ctx), CAS, "a"), ErrNotFound))
+
+	_, _, err = c.Reader(ctx, CAS, "d")
+	assert.True(errors.Is(err, ErrNotFound))
+}
@@ -0,0 +1,167 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"io"
+	"time"
+
+	health "github.com/etherlabsio/healthcheck/v2"
+)
+
+// Timeouts bounds how long each kind of call to a cache may take, unless
+// they're zero. Read and Write cover the whole transfer, up until the reader
+// or writer is closed.
+type Timeouts struct {
+	Exists time.Duration
+	Read   time.Duration
+	Write  time.Duration
+}
+
+// Timeout gives up on calls to a cache that take longer than their timeout,
+// so that a hung cache doesn't hold on to requests forever. Writes that run
+// out of time are discarded rather than stored.
+type Timeout struct {
+	cache    Cache
+	timeouts Timeouts
+}
+
+var _ Cache = &Timeout{}
+
+func NewTimeout(cache Cache, timeouts Timeouts) *Timeout {
+	return &Timeout{cache: cache, timeouts: timeouts}
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (c *Timeout) Exists(ctx context.Context, store Store, key Key) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Exists)
+	defer cancel()
+	return c.cache.Exists(ctx, store, key)
+}
+
+func (c *Timeout) Stat(ctx context.Context, store Store, key Key) (Info, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Exists)
+	defer cancel()
+	return c.cache.Stat(ctx, store, key)
+}
+
+func (c *Timeout) Reader(ctx context.Context, store Store, key Key) (io.Reader, int64, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Read)
+	reader, size, err := c.cache.Reader(ctx, store, key)
+	if err != nil {
+		cancel()
+		return nil, -1, err
+	}
+	return cancelReader{reader, cancel}, size, nil
+}
+
+var _ RangeReader = &Timeout{}
+
+func (c *Timeout) RangeReader(ctx context.Context, store Store, key Key, offset, length int64) (io.Reader, int64, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Read)
+	reader, size, err := ReadRange(ctx, c.cache, store, key, offset, length)
+	if err != nil {
+		cancel()
+		return nil, size, err
+	}
+	return cancelReader{reader, cancel}, size, nil
+}
+
+func (c *Timeout) Writer(ctx context.Context, store Store, key Key) (io.Writer, error) {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Write)
+	writer, err := c.cache.Writer(ctx, store, key)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timeoutWriter{Writer: writer, ctx: ctx, cancel: cancel}, nil
+}
+
+// timeoutWriter refuses writes once its context is done, and aborts instead
+// of closing, since not every cache watches the context itself.
+type timeoutWriter struct {
+	io.Writer
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.Writer.Write(p)
+}
+
+func (w *timeoutWriter) Close() error {
+	defer w.cancel()
+	if err := w.ctx.Err(); err != nil {
+		Abort(w.Writer)
+		return err
+	}
+	if closer, ok := w.Writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+var _ Aborter = &timeoutWriter{}
+
+func (w *timeoutWriter) Abort() error {
+	defer w.cancel()
+	return Abort(w.Writer)
+}
+
+var _ Deleter = &Timeout{}
+
+func (c *Timeout) Delete(ctx context.Context, store Store, key Key) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Exists)
+	defer cancel()
+	return Delete(ctx, c.cache, store, key)
+}
+
+var _ Walker = &Timeout{}
+
+func (c *Timeout) Walk(ctx context.Context, store Store, fn WalkFunc) error {
+	return Walk(ctx, c.cache, store, fn)
+}
+
+var _ SeekWalker = &Timeout{}
+
+func (c *Timeout) WalkAfter(ctx context.Context, store Store, after Key, fn WalkFunc) error {
+	return WalkAfter(ctx, c.cache, store, after, fn)
+}
+
+var _ Flusher = &Timeout{}
+
+func (c *Timeout) Flush(ctx context.Context) error {
+	return Flush(ctx, c.cache)
+}
+
+var _ health.Checker = &Timeout{}
+
+func (c *Timeout) Check(ctx context.Context) error {
+	if checker, ok := c.cache.(health.Checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hungCache doesn't answer until its context is done.
+type hungCache struct {
+	Cache
+}
+
+func (c hungCache) Exists(ctx context.Context, store Store, key Key) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c hungCache) Reader(ctx context.Context, store Store, key Key) (io.Reader, int64, error) {
+	<-ctx.Done()
+	return nil, -1, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mem := NewMemCache()
+
+	c := NewTimeout(hungCache{mem}, Timeouts{Exists: 10 * time.Millisecond, Read: 10 * time.Millisecond})
+	assert.True(errors.Is(c.Exists(ctx, CAS, "a"), context.DeadlineExceeded))
+	_, _, err := c.Reader(ctx, CAS, "a")
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+
+	// writes that run out of time are discarded
+	c = NewTimeout(mem, Timeouts{Write: 10 * time.Millisecond})
+	w, err := c.Writer(ctx, CAS, "a")
+	assert.NoError(err)
+	w.Write([]byte("foo"))
+	time.Sleep(20 * time.Millisecond)
+	_, err = w.Write([]byte("bar"))
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+	assert.Error(w.(io.Closer).Close())
+	assert.Equal(ErrNotFound, mem.Exists(ctx, CAS, "a"))
+
+	w, _ = c.Writer(ctx, CAS, "a")
+	w.Write([]byte("foo"))
+	assert.NoError(w.(io.Closer).Close())
+	assert.NoError(mem.Exists(ctx, CAS, "a"))
+
+	// the reader's context lasts until it's closed
+	r, size, err := c.Reader(ctx, CAS, "a")
+	assert.NoError(err)
+	assert.Equal(int64(3), size)
+	assert.NoError(r.(io.Closer).Close())
+}
@@ -0,0 +1,188 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	health "github.com/etherlabsio/healthcheck/v2"
+	"github.com/rs/zerolog"
+)
+
+// TTL hides entries that are older than a maximum age for their store, as
+// measured by the modification time the underlying cache reports. Expired
+// entries are treated as not found until Janitor removes them.
+type TTL struct {
+	cache  Cache
+	maxAge map[Store]time.Duration
+}
+
+var _ Cache = &TTL{}
+
+func NewTTLCache(cache Cache, maxAge map[Store]time.Duration) *TTL {
+	return &TTL{cache: cache, maxAge: maxAge}
+}
+
+func (c *TTL) expired(store Store, info Info) bool {
+	maxAge := c.maxAge[store]
+	return maxAge > 0 && !info.ModTime.IsZero() && time.Since(info.ModTime) > maxAge
+}
+
+// check returns ErrNotFound if the entry has expired. Stores without a
+// maximum age are not checked at all.
+func (c *TTL) check(ctx context.Context, store Store, key Key) error {
+	if c.maxAge[store] <= 0 {
+		return nil
+	}
+	_, err := c.Stat(ctx, store, key)
+	return err
+}
+
+func (c *TTL) Exists(ctx context.Context, store Store, key Key) error {
+	if c.maxAge[store] <= 0 {
+		return c.cache.Exists(ctx, store, key)
+	}
+	return c.check(ctx, store, key)
+}
+
+func (c *TTL) Stat(ctx context.Context, store Store, key Key) (Info, error) {
+	info, err := c.cache.Stat(ctx, store, key)
+	if err != nil {
+		return Info{}, err
+	}
+	if c.expired(store, info) {
+		zerolog.Ctx(ctx).Debug().Caller().
+			Stringer("store", store).
+			Stringer("key", key).
+			Time("modified", info.ModTime).
+			Msg("cache expired")
+		return Info{}, ErrNotFound
+	}
+	return info, nil
+}
+
+func (c *TTL) Reader(ctx context.Context, store Store, key Key) (io.Reader, int64, error) {
+	if err := c.check(ctx, store, key); err != nil {
+		return nil, -1, err
+	}
+	return c.cache.Reader(ctx, store, key)
+}
+
+var _ RangeReader = &TTL{}
+
+func (c *TTL) RangeReader(ctx context.Context, store Store, key Key, offset, length int64) (io.Reader, int64, error) {
+	if err := c.check(ctx, store, key); err != nil {
+		return nil, -1, err
+	}
+	return ReadRange(ctx, c.cache, store, key, offset, length)
+}
+
+func (c *TTL) Writer(ctx context.Context, store Store, key Key) (io.Writer, error) {
+	return c.cache.Writer(ctx, store, key)
+}
+
+var _ Deleter = &TTL{}
+
+func (c *TTL) Delete(ctx context.Context, store Store, key Key) error {
+	return Delete(ctx, c.cache, store, key)
+}
+
+var _ Walker = &TTL{}
+
+func (c *TTL) Walk(ctx context.Context, store Store, fn WalkFunc) error {
+	return c.WalkAfter(ctx, store, "", fn)
+}
+
+var _ SeekWalker = &TTL{}
+
+func (c *TTL) WalkAfter(ctx context.Context, store Store, after Key, fn WalkFunc) error {
+	return WalkAfter(ctx, c.cache, store, after, func(key Key, info Info) error {
+		if c.expired(store, info) {
+			return nil
+		}
+		return fn(key, info)
+	})
+}
+
+// Expire deletes the entries of store that are older than maxAge and returns
+// how many were deleted.
+func Expire(ctx context.Context, c Cache, store Store, maxAge time.Duration) (int, error) {
+	deleted := 0
+	cutoff := time.Now().Add(-maxAge)
+	err := Walk(ctx, c, store, func(key Key, info Info) error {
+		if info.ModTime.IsZero() || info.ModTime.After(cutoff) {
+			return nil
+		}
+		if err := Delete(ctx, c, store, key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		deleted++
+		return nil
+	})
+	return deleted, err
+}
+
+// Janitor removes expired entries from the underlying cache every interval
+// until ctx is done.
+func (c *TTL) Janitor(ctx context.Context, interval time.Duration) {
+	log := zerolog.Ctx(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for store, maxAge := range c.maxAge {
+			if maxAge <= 0 {
+				continue
+			}
+			deleted, err := Expire(ctx, c.cache, store, maxAge)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					log.Err(err).Stringer("store", store).Msg("cache expire")
+				}
+				continue
+			}
+			log.Info().
+				Stringer("store", store).
+				Dur("max age", maxAge).
+				Int("deleted", deleted).
+				Msg("cache expire")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var _ Flusher = &TTL{}
+
+func (c *TTL) Flush(ctx context.Context) error {
+	return Flush(ctx, c.cache)
+}
+
+var _ health.Checker = &TTL{}
+
+func (c *TTL) Check(ctx context.Context) error {
+	if checker, ok := c.cache.(health.Checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
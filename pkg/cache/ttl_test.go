@@ -0,0 +1,60 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTL(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mem := NewMemCache()
+	fill(mem, AC)
+	fill(mem, CAS)
+
+	stale, _ := keyFromDigest(digests[0])
+	mem.mp[resolve(AC, stale)].modTime = time.Now().Add(-48 * time.Hour)
+	mem.mp[resolve(CAS, stale)].modTime = time.Now().Add(-48 * time.Hour)
+
+	ttl := NewTTLCache(NewLRUCache(mem, 1024), map[Store]time.Duration{AC: 24 * time.Hour})
+	assert.ErrorIs(ttl.Exists(ctx, AC, stale), ErrNotFound)
+	_, _, err := ttl.Reader(ctx, AC, stale)
+	assert.ErrorIs(err, ErrNotFound)
+	_, _, err = ReadRange(ctx, ttl, AC, stale, 0, 1)
+	assert.ErrorIs(err, ErrNotFound)
+	assert.NoError(ttl.Exists(ctx, CAS, stale))
+
+	fresh, _ := keyFromDigest(digests[1])
+	assert.NoError(ttl.Exists(ctx, AC, fresh))
+
+	walked := 0
+	Walk(ctx, ttl, AC, func(Key, Info) error {
+		walked++
+		return nil
+	})
+	assert.Equal(len(digests)-1, walked)
+
+	deleted, err := Expire(ctx, mem, AC, 24*time.Hour)
+	assert.NoError(err)
+	assert.Equal(1, deleted)
+	assert.ErrorIs(mem.Exists(ctx, AC, stale), ErrNotFound)
+	assert.NoError(mem.Exists(ctx, CAS, stale))
+}
@@ -0,0 +1,152 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package verify checks that CAS blobs still hash to their keys.
+package verify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sync"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/cache/scan"
+	"github.com/rs/zerolog"
+)
+
+// Quarantine is where corrupted blobs are moved when Options.Quarantine is
+// set, under the same key they had in the CAS.
+const Quarantine cache.Store = "quarantine"
+
+type Options struct {
+	scan.Options
+	// Quarantine moves corrupted blobs out of the CAS instead of only
+	// reporting them.
+	Quarantine bool
+}
+
+type Report struct {
+	Verified int   `json:"verified"`
+	Bytes    int64 `json:"bytes"`
+	Corrupt  int   `json:"corrupt"`
+}
+
+// Verify hashes every CAS blob in c and compares it to its key.
+func Verify(ctx context.Context, c cache.Cache, opts Options) (Report, error) {
+	log := zerolog.Ctx(ctx)
+	report := Report{}
+	var lock sync.Mutex
+
+	err := scan.Scan(ctx, c, []cache.Store{cache.CAS}, opts.Options, func(ctx context.Context, store cache.Store, key cache.Key, _ cache.Info) error {
+		size, corrupt, err := verify(ctx, c, key, opts.Quarantine)
+		if err != nil {
+			return err
+		}
+		if corrupt {
+			log.Warn().Stringer("key", key).Bool("quarantined", opts.Quarantine).Msg("verify corrupt blob")
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		report.Verified++
+		report.Bytes += size
+		if corrupt {
+			report.Corrupt++
+		}
+		return nil
+	})
+	return report, err
+}
+
+func verify(ctx context.Context, c cache.Cache, key cache.Key, quarantine bool) (int64, bool, error) {
+	size, ok, err := check(ctx, c, key, ioutil.Discard)
+	if errors.Is(err, cache.ErrNotFound) {
+		// deleted since the walk found it
+		return 0, false, nil
+	} else if err != nil || ok {
+		return size, false, err
+	}
+	if quarantine {
+		if err := move(ctx, c, key); err != nil {
+			return 0, false, err
+		}
+	}
+	return size, true, nil
+}
+
+// check hashes the blob at key while copying it to w, and reports whether it
+// matches its key.
+func check(ctx context.Context, c cache.Cache, key cache.Key, w io.Writer) (int64, bool, error) {
+	reader, _, err := c.Reader(ctx, cache.CAS, key)
+	if err != nil {
+		return 0, false, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(h, w), reader)
+	if err != nil {
+		return 0, false, err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)) == path.Base(string(key)), nil
+}
+
+// errRepaired stops quarantining a blob that was rewritten with the right
+// content since it was found to be corrupt.
+var errRepaired = errors.New("verify: blob repaired")
+
+// move copies a corrupted blob to the quarantine store, reading it again
+// rather than holding every blob in memory, and then deletes it from the CAS.
+// The copy is flushed and looked up first, so that a failed upload to a cache
+// that writes in the background doesn't lose the blob.
+func move(ctx context.Context, c cache.Cache, key cache.Key) error {
+	writer, err := c.Writer(ctx, Quarantine, key)
+	if err != nil {
+		return err
+	}
+	_, ok, err := check(ctx, c, key, writer)
+	if err == nil && ok {
+		err = errRepaired
+	}
+	if err != nil {
+		cache.Abort(writer)
+		if errors.Is(err, errRepaired) || errors.Is(err, cache.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if closer, ok := writer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := cache.Flush(ctx, c); err != nil {
+		return err
+	}
+	if err := c.Exists(ctx, Quarantine, key); err != nil {
+		return fmt.Errorf("verify: quarantined copy of %s is missing: %w", key, err)
+	}
+	return cache.Delete(ctx, c, cache.CAS, key)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package verify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dmorgan81/buzzel/pkg/cache"
+	"github.com/dmorgan81/buzzel/pkg/cache/scan"
+	"github.com/stretchr/testify/assert"
+)
+
+func put(c cache.Cache, hash string, data string) cache.Key {
+	key := cache.Key(hash[:2] + "/" + hash)
+	w, _ := c.Writer(context.Background(), cache.CAS, key)
+	io.WriteString(w, data)
+	w.(io.Closer).Close()
+	return key
+}
+
+func good(c cache.Cache, data string) cache.Key {
+	sum := sha256.Sum256([]byte(data))
+	return put(c, hex.EncodeToString(sum[:]), data)
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	c := cache.NewMemCache()
+	for _, data := range []string{"foo", "bar", "baz", "qux"} {
+		good(c, data)
+	}
+	sum := sha256.Sum256([]byte("foo"))
+	bad := put(c, "00"+hex.EncodeToString(sum[1:]), "rotten")
+
+	report, err := Verify(ctx, c, Options{Options: scan.Options{Parallel: 2}})
+	assert.NoError(err)
+	assert.Equal(Report{Verified: 5, Bytes: 18, Corrupt: 1}, report)
+	assert.NoError(c.Exists(ctx, cache.CAS, bad))
+
+	report, err = Verify(ctx, c, Options{Options: scan.Options{Parallel: 2}, Quarantine: true})
+	assert.NoError(err)
+	assert.Equal(1, report.Corrupt)
+	assert.ErrorIs(c.Exists(ctx, cache.CAS, bad), cache.ErrNotFound)
+	assert.NoError(c.Exists(ctx, Quarantine, bad))
+
+	report, err = Verify(ctx, c, Options{})
+	assert.NoError(err)
+	assert.Equal(Report{Verified: 4, Bytes: 12}, report)
+}
+
+// failingFlusher is a cache whose writes fail once they're flushed.
+type failingFlusher struct {
+	cache.Cache
+}
+
+func (failingFlusher) Flush(context.Context) error {
+	return errors.New("upload failed")
+}
+
+func TestVerifyMove(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	c := cache.NewMemCache()
+	sum := sha256.Sum256([]byte("foo"))
+	bad := put(c, "00"+hex.EncodeToString(sum[1:]), "rotten")
+
+	// the blob is only deleted once its copy is stored
+	assert.Error(move(ctx, failingFlusher{c}, bad))
+	assert.NoError(c.Exists(ctx, cache.CAS, bad))
+
+	// and not quarantined at all if it's been repaired since
+	repaired := good(c, "foo")
+	assert.NoError(move(ctx, c, repaired))
+	assert.NoError(c.Exists(ctx, cache.CAS, repaired))
+	assert.ErrorIs(c.Exists(ctx, Quarantine, repaired), cache.ErrNotFound)
+}
+
+func TestVerifyCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	c := cache.NewMemCache()
+	for _, data := range []string{"foo", "bar", "baz", "qux"} {
+		good(c, data)
+	}
+
+	dir, err := ioutil.TempDir("", "verify")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "checkpoint")
+
+	// pretend a previous run got through the first two keys in order
+	var sorted []cache.Key
+	cache.Walk(ctx, c, cache.CAS, func(key cache.Key, _ cache.Info) error {
+		sorted = append(sorted, key)
+		return nil
+	})
+	assert.NoError(ioutil.WriteFile(checkpoint, []byte("cas/"+sorted[1]+"\n"), 0600))
+
+	report, err := Verify(ctx, c, Options{Options: scan.Options{Checkpoint: checkpoint}})
+	assert.NoError(err)
+	assert.Equal(2, report.Verified)
+
+	_, err = os.Stat(checkpoint)
+	assert.ErrorIs(err, os.ErrNotExist)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrWarming is reported by CheckWarm while the LRU is being warmed.
+var ErrWarming = errors.New("warming up")
+
+// Snapshot lists the entries held in memory, most recently used first, one
+// "store/key" per line.
+func (c *LRU) Snapshot() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	buf := &bytes.Buffer{}
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		en := el.Value.(*entry)
+		fmt.Fprintln(buf, resolve(en.store, en.key))
+	}
+	return buf.Bytes()
+}
+
+// SaveSnapshot writes a snapshot to file, replacing the last one only once
+// it's complete. It's kept next to the server rather than in the underlying
+// cache, which may not take keys outside of its stores.
+func (c *LRU) SaveSnapshot(file string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(c.Snapshot()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// Snapshotter saves a snapshot to file every interval until ctx is done.
+func (c *LRU) Snapshotter(ctx context.Context, file string, interval time.Duration) {
+	log := zerolog.Ctx(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.SaveSnapshot(file); err != nil {
+			log.Err(err).Msg("cache snapshot")
+		}
+	}
+}
+
+// Warm loads the entries listed in the snapshot last saved to file, hottest
+// first, until they're all loaded, the LRU is full or ctx is done. Entries
+// that don't fit in what's left are skipped. CheckWarm reports ErrWarming
+// until it returns. It returns how many entries were loaded.
+func (c *LRU) Warm(ctx context.Context, file string) (int, error) {
+	c.SetWarming()
+	defer atomic.StoreInt32(&c.warming, 0)
+
+	reader, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	loaded := 0
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return loaded, err
+		}
+		i := strings.IndexByte(scanner.Text(), '/')
+		if i < 0 {
+			continue
+		}
+		store, key := Store(scanner.Text()[:i]), Key(scanner.Text()[i+1:])
+
+		ok, err := c.warm(ctx, store, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return loaded, err
+		}
+		if ok {
+			loaded++
+		}
+		if c.Size() >= c.Max() {
+			break
+		}
+	}
+	return loaded, scanner.Err()
+}
+
+// SetWarming makes CheckWarm fail until Warm returns. Call it before a server
+// starts listening when Warm runs in the background, so that the server isn't
+// ready before warming starts.
+func (c *LRU) SetWarming() {
+	atomic.StoreInt32(&c.warming, 1)
+}
+
+// CheckWarm fails while Warm is running. It's meant to be used as a
+// health.CheckerFunc.
+func (c *LRU) CheckWarm(context.Context) error {
+	if atomic.LoadInt32(&c.warming) != 0 {
+		return ErrWarming
+	}
+	return nil
+}
+
+// warm loads one entry behind the ones already warmed, so that it's evicted
+// before them. It reports whether the entry was loaded, which it isn't if it
+// doesn't fit.
+func (c *LRU) warm(ctx context.Context, store Store, key Key) (bool, error) {
+	info, err := c.cache.Stat(ctx, store, key)
+	if err != nil {
+		return false, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.mp[resolve(store, key)]; ok {
+		return false, nil
+	}
+	if info.Size+c.size > c.max {
+		return false, nil
+	}
+	reader, _, err := c.load(ctx, store, key)
+	if err != nil {
+		return false, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		closer.Close()
+	}
+	if el, ok := c.mp[resolve(store, key)]; ok {
+		el.Value.(*entry).modTime = info.ModTime
+		c.ll.MoveToBack(el)
+	}
+	return true, nil
+}
@@ -0,0 +1,291 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package reapi encodes and decodes the parts of the Bazel Remote Execution
+// API messages that buzzel cares about, straight from the protobuf wire
+// format. Field numbers come from
+// build/bazel/remote/execution/v2/remote_execution.proto.
+package reapi
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Digest identifies a blob in the CAS by the SHA-256 hash of its content and
+// its size.
+type Digest struct {
+	Hash string
+	Size int64
+}
+
+// ActionResult holds the blobs referenced by an ActionResult.
+type ActionResult struct {
+	// Files are the output files along with stdout and stderr.
+	Files []Digest
+	// Trees are the Tree messages describing each output directory.
+	Trees []Digest
+	// Directories are the root Directory messages of each output directory,
+	// if the client provided them.
+	Directories []Digest
+}
+
+// Tree holds the blobs referenced by a Tree.
+type Tree struct {
+	Files       []Digest
+	Directories []Digest
+}
+
+// Directory holds the blobs referenced by a Directory: its files and the
+// Directory messages of its subdirectories.
+type Directory struct {
+	Files       []Digest
+	Directories []Digest
+}
+
+var ErrMalformed = errors.New("reapi: malformed message")
+
+// fields calls fn for each field of an encoded message. Length delimited
+// fields are passed their bytes; fields of other types are skipped.
+func fields(b []byte, fn func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ErrMalformed
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return ErrMalformed
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return ErrMalformed
+		}
+		b = b[n:]
+		if err := fn(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Field returns the value of the last occurrence of field num in an encoded
+// message, or nothing if it isn't there. Length delimited values keep their
+// length prefix.
+func Field(b []byte, num protowire.Number) ([]byte, bool, error) {
+	var value []byte
+	found := false
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return nil, false, ErrMalformed
+		}
+		b = b[l:]
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		if l < 0 {
+			return nil, false, ErrMalformed
+		}
+		if n == num {
+			value, found = b[:l], true
+		}
+		b = b[l:]
+	}
+	return value, found, nil
+}
+
+// AppendString appends s to b as field num of a message, unless it's empty.
+func AppendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// AppendVarint appends v to b as field num of a message, unless it's zero.
+func AppendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// AppendBytes appends v to b as field num of a message.
+func AppendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// DecodeDigest decodes a Digest message.
+func DecodeDigest(b []byte) (Digest, error) {
+	var d Digest
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return Digest{}, ErrMalformed
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return Digest{}, ErrMalformed
+			}
+			d.Hash = v
+			b = b[n:]
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return Digest{}, ErrMalformed
+			}
+			d.Size = int64(v)
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return Digest{}, ErrMalformed
+			}
+			b = b[n:]
+		}
+	}
+	return d, nil
+}
+
+// AppendDigest appends d to b as field num of a message.
+func AppendDigest(b []byte, num protowire.Number, d Digest) []byte {
+	var v []byte
+	v = protowire.AppendTag(v, 1, protowire.BytesType)
+	v = protowire.AppendString(v, d.Hash)
+	if d.Size != 0 {
+		v = protowire.AppendTag(v, 2, protowire.VarintType)
+		v = protowire.AppendVarint(v, uint64(d.Size))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// digestField decodes the Digest in field num of an encoded message, if
+// there is one.
+func digestField(b []byte, num protowire.Number) (Digest, bool, error) {
+	var d Digest
+	found := false
+	err := fields(b, func(n protowire.Number, v []byte) error {
+		if n != num {
+			return nil
+		}
+		var err error
+		d, err = DecodeDigest(v)
+		found = err == nil
+		return err
+	})
+	return d, found, err
+}
+
+// DecodeActionResult decodes the blobs referenced by an ActionResult.
+func DecodeActionResult(b []byte) (*ActionResult, error) {
+	ar := &ActionResult{}
+	err := fields(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 2: // output_files
+			d, ok, err := digestField(v, 2)
+			if ok {
+				ar.Files = append(ar.Files, d)
+			}
+			return err
+		case 3: // output_directories
+			tree, ok, err := digestField(v, 3)
+			if err != nil {
+				return err
+			}
+			if ok {
+				ar.Trees = append(ar.Trees, tree)
+			}
+			root, ok, err := digestField(v, 5)
+			if ok {
+				ar.Directories = append(ar.Directories, root)
+			}
+			return err
+		case 6, 8: // stdout_digest, stderr_digest
+			d, err := DecodeDigest(v)
+			if err == nil && d.Hash != "" {
+				ar.Files = append(ar.Files, d)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ar, nil
+}
+
+// DecodeTree decodes the blobs referenced by a Tree.
+func DecodeTree(b []byte) (*Tree, error) {
+	tree := &Tree{}
+	err := fields(b, func(num protowire.Number, v []byte) error {
+		if num != 1 && num != 2 { // root, children
+			return nil
+		}
+		dir, err := DecodeDirectory(v)
+		if err != nil {
+			return err
+		}
+		tree.Files = append(tree.Files, dir.Files...)
+		tree.Directories = append(tree.Directories, dir.Directories...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// DecodeDirectory decodes the blobs referenced by a Directory.
+func DecodeDirectory(b []byte) (*Directory, error) {
+	dir := &Directory{}
+	err := fields(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1: // files
+			d, ok, err := digestField(v, 2)
+			if ok {
+				dir.Files = append(dir.Files, d)
+			}
+			return err
+		case 2: // directories
+			d, ok, err := digestField(v, 2)
+			if ok {
+				dir.Directories = append(dir.Directories, d)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
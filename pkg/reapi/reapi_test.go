@@ -0,0 +1,107 @@
+/*
+Copyright © 2022 David Morgan <dmorgan81@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package reapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func digest(hash string, size int64) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendString(b, hash)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(size))
+}
+
+func message(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func TestDecodeActionResult(t *testing.T) {
+	assert := assert.New(t)
+
+	file := message(nil, 1, []byte("out/foo"))
+	file = message(file, 2, digest("aaaa", 3))
+	file = protowire.AppendTag(file, 4, protowire.VarintType)
+	file = protowire.AppendVarint(file, 1)
+
+	dir := message(nil, 1, []byte("out/dir"))
+	dir = message(dir, 3, digest("bbbb", 10))
+	dir = message(dir, 5, digest("cccc", 5))
+
+	var ar []byte
+	ar = message(ar, 2, file)
+	ar = message(ar, 3, dir)
+	ar = protowire.AppendTag(ar, 4, protowire.VarintType)
+	ar = protowire.AppendVarint(ar, 0)
+	ar = message(ar, 5, []byte("inline stdout"))
+	ar = message(ar, 6, digest("dddd", 1))
+	ar = message(ar, 8, digest("eeee", 2))
+
+	decoded, err := DecodeActionResult(ar)
+	assert.NoError(err)
+	assert.Equal([]Digest{{"aaaa", 3}, {"dddd", 1}, {"eeee", 2}}, decoded.Files)
+	assert.Equal([]Digest{{"bbbb", 10}}, decoded.Trees)
+	assert.Equal([]Digest{{"cccc", 5}}, decoded.Directories)
+
+	_, err = DecodeActionResult([]byte{0xff, 0xff})
+	assert.ErrorIs(err, ErrMalformed)
+}
+
+func TestDecodeTree(t *testing.T) {
+	assert := assert.New(t)
+
+	fileNode := func(name, hash string) []byte {
+		return message(message(nil, 1, []byte(name)), 2, digest(hash, 1))
+	}
+
+	var child []byte
+	child = message(child, 1, fileNode("b", "2222"))
+
+	var root []byte
+	root = message(root, 1, fileNode("a", "1111"))
+	root = message(root, 2, message(message(nil, 1, []byte("sub")), 2, digest("3333", 4)))
+
+	var tree []byte
+	tree = message(tree, 1, root)
+	tree = message(tree, 2, child)
+
+	decoded, err := DecodeTree(tree)
+	assert.NoError(err)
+	assert.Equal([]Digest{{"1111", 1}, {"2222", 1}}, decoded.Files)
+	assert.Equal([]Digest{{"3333", 4}}, decoded.Directories)
+
+	dir, err := DecodeDirectory(root)
+	assert.NoError(err)
+	assert.Equal([]Digest{{"1111", 1}}, dir.Files)
+	assert.Equal([]Digest{{"3333", 4}}, dir.Directories)
+}
+
+func TestAppendDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	b := AppendDigest(nil, 2, Digest{"aaaa", 3})
+	assert.Equal(message(nil, 2, digest("aaaa", 3)), b)
+
+	d, found, err := digestField(b, 2)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(Digest{"aaaa", 3}, d)
+}